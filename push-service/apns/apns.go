@@ -0,0 +1,334 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/http2"
+
+	"github.com/ezrahel/models"
+)
+
+// ProviderName is the name the APNs provider is registered under.
+const ProviderName = "apns"
+
+// Apple Push Notification service endpoints.
+const (
+	ProductionURL = "https://api.push.apple.com"
+	SandboxURL    = "https://api.sandbox.push.apple.com"
+)
+
+// Apple rejects provider tokens older than one hour and throttles clients that
+// refresh more often than every 20 minutes, so tokens are reused for 50 minutes.
+const tokenLifetime = 50 * time.Minute
+
+// Config holds the token-based (.p8) authentication settings for APNs.
+type Config struct {
+	KeyID      string            // Key ID of the .p8 signing key
+	TeamID     string            // Apple Developer Team ID
+	Topic      string            // App bundle ID, sent as apns-topic
+	PrivateKey *ecdsa.PrivateKey // Parsed .p8 signing key
+	Production bool              // Use the production endpoint instead of the sandbox
+	BaseURL    string            // Overrides the endpoint (used for local test servers)
+	TLSConfig  *tls.Config       // Optional TLS settings for the HTTP/2 connection
+	Timeout    time.Duration     // Per-request timeout, defaults to 10s
+}
+
+// Provider delivers push notifications to iOS devices over the APNs HTTP/2 API.
+type Provider struct {
+	cfg     Config
+	baseURL string
+	client  *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// Error is a rejection returned by APNs for a single notification.
+type Error struct {
+	StatusCode int
+	Reason     string
+	Timestamp  time.Time     // Set for 410 responses: when the token stopped being valid
+	RetryAfter time.Duration // Retry-After sent with 429 and 503 responses, if any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("apns responded with status %d: %s", e.StatusCode, e.Reason)
+}
+
+// LoadPrivateKey reads and parses a .p8 signing key downloaded from the Apple Developer portal.
+func LoadPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %w", err)
+	}
+	return ParsePrivateKey(raw)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS#8 ECDSA key.
+func ParsePrivateKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("APNs key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APNs key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key must be an ECDSA (ES256) key")
+	}
+	return ecKey, nil
+}
+
+// NewProvider validates the configuration and prepares the shared HTTP/2 client.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.KeyID == "" || cfg.TeamID == "" || cfg.Topic == "" {
+		return nil, errors.New("apns: key ID, team ID and topic are required")
+	}
+	if cfg.PrivateKey == nil {
+		return nil, errors.New("apns: private key is required")
+	}
+
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = SandboxURL
+		if cfg.Production {
+			baseURL = ProductionURL
+		}
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	// A single http2.Transport keeps one multiplexed connection per host,
+	// which is how Apple expects providers to talk to APNs.
+	transport := &http2.Transport{
+		TLSClientConfig: cfg.TLSConfig,
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     10 * time.Second,
+	}
+
+	return &Provider{
+		cfg:     cfg,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Name implements middleware.PushProvider.
+func (p *Provider) Name() string { return ProviderName }
+
+// Send posts one notification to /3/device/<token> and returns the apns-id.
+func (p *Provider) Send(ctx context.Context, msg models.PushMessage) (string, error) {
+	body, err := json.Marshal(buildPayload(msg))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode APNs payload: %w", err)
+	}
+
+	token, err := p.providerToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/3/device/"+msg.Token, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	topic := p.cfg.Topic
+	if msg.AppID != "" {
+		topic = msg.AppID
+	}
+	req.Header.Set("apns-topic", topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("apns request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return resp.Header.Get("apns-id"), nil
+	}
+
+	apnsErr := parseError(resp)
+	if apnsErr.Reason == "ExpiredProviderToken" {
+		// Force a fresh token for the retry.
+		p.resetToken()
+	}
+	return "", apnsErr
+}
+
+// SendBatch sends each message over the shared connection; HTTP/2 multiplexes the requests.
+func (p *Provider) SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error) {
+	results := make([]models.SendResult, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		go func(i int, msg models.PushMessage) {
+			defer wg.Done()
+			id, err := p.Send(ctx, msg)
+			results[i] = models.SendResult{Token: msg.Token, MessageID: id, Error: err}
+		}(i, msg)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// ClassifyError maps APNs reason codes to the worker's failure classes.
+func (p *Provider) ClassifyError(err error) models.ErrorClass {
+	if err == nil {
+		return ""
+	}
+	var apnsErr *Error
+	if !errors.As(err, &apnsErr) {
+		// Network failures, timeouts, connection resets.
+		return models.ErrorClassTransient
+	}
+
+	switch apnsErr.Reason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic", "ExpiredToken",
+		"MissingDeviceToken", "BadTopic", "TopicDisallowed", "PayloadTooLarge",
+		"BadCollapseId", "BadExpirationDate", "BadPriority", "InvalidPushType",
+		"MissingTopic", "PayloadEmpty":
+		return models.ErrorClassPermanent
+	case "TooManyRequests", "TooManyProviderTokenUpdates":
+		return models.ErrorClassThrottled
+	case "ExpiredProviderToken", "InvalidProviderToken", "MissingProviderToken",
+		"InternalServerError", "ServiceUnavailable", "Shutdown", "IdleTimeout":
+		// Credential problems affect every device, so they are retried rather than
+		// dropping the job; the circuit breaker stops us hammering APNs meanwhile.
+		return models.ErrorClassTransient
+	}
+
+	switch {
+	case apnsErr.StatusCode == http.StatusTooManyRequests:
+		return models.ErrorClassThrottled
+	case apnsErr.StatusCode >= 500:
+		return models.ErrorClassTransient
+	case apnsErr.StatusCode >= 400:
+		return models.ErrorClassPermanent
+	default:
+		return models.ErrorClassTransient
+	}
+}
+
+// IsTokenInvalid reports the reasons APNs uses for tokens that will never work again.
+func (p *Provider) IsTokenInvalid(err error) bool {
+	var apnsErr *Error
+	if !errors.As(err, &apnsErr) {
+		return false
+	}
+	switch apnsErr.Reason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic", "ExpiredToken":
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns the back-off APNs asked for with a 429 or 503 response.
+func (p *Provider) RetryAfter(err error) time.Duration {
+	var apnsErr *Error
+	if errors.As(err, &apnsErr) {
+		return apnsErr.RetryAfter
+	}
+	return 0
+}
+
+// providerToken returns the cached ES256 provider token, signing a new one when it is too old.
+func (p *Provider) providerToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.token != "" && now.Sub(p.issuedAt) < tokenLifetime {
+		return p.token, nil
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": p.cfg.TeamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = p.cfg.KeyID
+
+	signed, err := token.SignedString(p.cfg.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign APNs provider token: %w", err)
+	}
+	p.token, p.issuedAt = signed, now
+	return signed, nil
+}
+
+func (p *Provider) resetToken() {
+	p.mu.Lock()
+	p.token = ""
+	p.mu.Unlock()
+}
+
+// buildPayload converts a PushMessage into the APNs JSON payload.
+func buildPayload(msg models.PushMessage) map[string]interface{} {
+	aps := map[string]interface{}{
+		"alert": map[string]string{
+			"title": msg.Title,
+			"body":  msg.Body,
+		},
+		"sound": "default",
+	}
+	payload := map[string]interface{}{}
+	for k, v := range msg.Data {
+		payload[k] = v
+	}
+	if msg.LinkURL != "" {
+		payload["link_url"] = msg.LinkURL
+	}
+	if msg.ImageURL != "" {
+		// A notification service extension downloads the image on the device.
+		aps["mutable-content"] = 1
+		payload["image_url"] = msg.ImageURL
+	}
+	payload["aps"] = aps
+	return payload
+}
+
+// parseError decodes the {"reason": ...} body APNs sends with every failure.
+func parseError(resp *http.Response) *Error {
+	apnsErr := &Error{StatusCode: resp.StatusCode}
+
+	var body struct {
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+		apnsErr.Reason = body.Reason
+		if body.Timestamp > 0 {
+			apnsErr.Timestamp = time.UnixMilli(body.Timestamp)
+		}
+	}
+	if apnsErr.Reason == "" {
+		apnsErr.Reason = http.StatusText(resp.StatusCode)
+	}
+	apnsErr.RetryAfter = models.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return apnsErr
+}
@@ -0,0 +1,186 @@
+package apns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ezrahel/models"
+)
+
+// newTestServer starts a TLS HTTP/2 stand-in for APNs and a provider pointed at it.
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*Provider, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	p, err := NewProvider(Config{
+		KeyID:      "ABC123DEFG",
+		TeamID:     "DEF123GHIJ",
+		Topic:      "com.example.app",
+		PrivateKey: key,
+		BaseURL:    srv.URL,
+		TLSConfig:  &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, key
+}
+
+func TestSendSignsTokenAndPostsPayload(t *testing.T) {
+	var key *ecdsa.PrivateKey
+	var p *Provider
+	p, key = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, got %s", r.Proto)
+		}
+		if r.URL.Path != "/3/device/device-token" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("apns-topic"); got != "com.example.app" {
+			t.Errorf("apns-topic = %q", got)
+		}
+
+		raw := strings.TrimPrefix(r.Header.Get("authorization"), "bearer ")
+		token, err := jwt.Parse(raw, func(tok *jwt.Token) (interface{}, error) {
+			if tok.Header["kid"] != "ABC123DEFG" {
+				t.Errorf("kid = %v", tok.Header["kid"])
+			}
+			return &key.PublicKey, nil
+		}, jwt.WithValidMethods([]string{"ES256"}))
+		if err != nil || !token.Valid {
+			t.Errorf("invalid provider token: %v", err)
+		}
+
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		alert := payload["aps"].(map[string]interface{})["alert"].(map[string]interface{})
+		if alert["title"] != "Hello" || payload["link_url"] != "https://example.com" {
+			t.Errorf("unexpected payload %v", payload)
+		}
+
+		w.Header().Set("apns-id", "apns-123")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	id, err := p.Send(context.Background(), models.PushMessage{
+		Token:   "device-token",
+		Title:   "Hello",
+		Body:    "World",
+		LinkURL: "https://example.com",
+	})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if id != "apns-123" {
+		t.Errorf("message ID = %q, want apns-123", id)
+	}
+}
+
+func TestProviderTokenIsReused(t *testing.T) {
+	var tokens []string
+	p, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("authorization"))
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.Send(context.Background(), models.PushMessage{Token: "t"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tokens) != 2 || tokens[0] != tokens[1] {
+		t.Errorf("expected the provider token to be reused, got %v", tokens)
+	}
+}
+
+func TestSendReusesOneConnection(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	p, err := NewProvider(Config{
+		KeyID: "k", TeamID: "t", Topic: "com.example.app", PrivateKey: key,
+		BaseURL: srv.URL, TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]models.PushMessage, 20)
+	for i := range msgs {
+		msgs[i] = models.PushMessage{Token: "t"}
+	}
+	results, _ := p.SendBatch(context.Background(), msgs)
+	for _, r := range results {
+		if r.Error != nil {
+			t.Fatalf("unexpected error: %v", r.Error)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestSendMapsReasonCodes(t *testing.T) {
+	tests := []struct {
+		status int
+		reason string
+		want   models.ErrorClass
+	}{
+		{http.StatusBadRequest, "BadDeviceToken", models.ErrorClassPermanent},
+		{http.StatusGone, "Unregistered", models.ErrorClassPermanent},
+		{http.StatusTooManyRequests, "TooManyRequests", models.ErrorClassThrottled},
+		{http.StatusServiceUnavailable, "ServiceUnavailable", models.ErrorClassTransient},
+		{http.StatusForbidden, "ExpiredProviderToken", models.ErrorClassTransient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			p, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(map[string]string{"reason": tt.reason})
+			})
+
+			_, err := p.Send(context.Background(), models.PushMessage{Token: "t"})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := p.ClassifyError(err); got != tt.want {
+				t.Errorf("ClassifyError(%s) = %s, want %s", tt.reason, got, tt.want)
+			}
+		})
+	}
+}
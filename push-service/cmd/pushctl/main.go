@@ -0,0 +1,268 @@
+// Command pushctl is the operator tool for the push service.
+//
+//	pushctl dlq list [--limit N]
+//	pushctl dlq show <request-id> [--limit N]
+//	pushctl dlq replay <request-id>... [--limit N] | --all
+//	pushctl dlq purge [--yes]
+//
+// It reads the same configuration file (PUSH_CONFIG_FILE) and environment variables as the worker,
+// but only needs the RabbitMQ settings (RABBITMQ_URL, NOTIFICATION_EXCHANGE, PUSH_QUEUE_NAME, ...).
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezrahel/dlq"
+	"github.com/ezrahel/internals"
+	"github.com/ezrahel/middleware"
+	"github.com/spf13/cobra"
+	"github.com/streadway/amqp"
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "pushctl",
+		Short:         "Operate the push notification service",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.AddCommand(dlqCommand())
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// searchLimit bounds how much of the DLQ show and replay read while looking for request IDs: every
+// message read stays unacknowledged in this process until it exits.
+const searchLimit = 1000
+
+func dlqCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dlq",
+		Short: "Inspect and replay jobs in the dead-letter queue (" + middleware.FailedQueue + ")",
+	}
+
+	var limit int
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List dead-lettered jobs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withInspector(func(in *dlq.Inspector) error {
+				msgs, err := in.Fetch(limit)
+				if err != nil {
+					return err
+				}
+				printList(cmd.OutOrStdout(), msgs)
+				return nil
+			})
+		},
+	}
+	list.Flags().IntVar(&limit, "limit", 50, "maximum number of messages to list (0 for all)")
+
+	var showLimit int
+	show := &cobra.Command{
+		Use:   "show <request-id>",
+		Short: "Show one dead-lettered job with its headers",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withInspector(func(in *dlq.Inspector) error {
+				found, _, err := in.Search(args, showLimit)
+				if err != nil {
+					return err
+				}
+				if len(found) == 0 {
+					return fmt.Errorf("no job with request ID %s in %s%s", args[0], middleware.FailedQueue, searched(showLimit))
+				}
+				printMessage(cmd.OutOrStdout(), found[0])
+				return nil
+			})
+		},
+	}
+	show.Flags().IntVar(&showLimit, "limit", searchLimit, "maximum number of messages to search (0 for all)")
+
+	var all bool
+	var replayLimit int
+	replay := &cobra.Command{
+		Use:   "replay [request-id...]",
+		Short: "Send jobs back to the push queue with their retry count reset",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return errors.New("pass request IDs or --all")
+			}
+			return withInspector(func(in *dlq.Inspector) error {
+				var msgs []dlq.Message
+				var err error
+				if all {
+					msgs, err = in.Fetch(0)
+				} else {
+					var missing []string
+					msgs, missing, err = in.Search(args, replayLimit)
+					if len(missing) > 0 {
+						fmt.Fprintf(cmd.ErrOrStderr(), "Not in %s%s: %s\n", middleware.FailedQueue, searched(replayLimit), strings.Join(missing, ", "))
+					}
+				}
+				if err != nil {
+					return err
+				}
+				n, err := in.Replay(msgs)
+				fmt.Fprintf(cmd.OutOrStdout(), "Replayed %d job(s).\n", n)
+				return err
+			})
+		},
+	}
+	replay.Flags().BoolVar(&all, "all", false, "replay every job in the queue")
+	replay.Flags().IntVar(&replayLimit, "limit", searchLimit, "maximum number of messages to search for the request IDs (0 for all)")
+
+	var yes bool
+	purge := &cobra.Command{
+		Use:   "purge",
+		Short: "Delete every job in the dead-letter queue",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withInspector(func(in *dlq.Inspector) error {
+				count, err := in.Count()
+				if err != nil {
+					return err
+				}
+				if !yes && !confirm(cmd.InOrStdin(), cmd.OutOrStdout(), fmt.Sprintf("Delete %d job(s) from %s? This cannot be undone. [y/N] ", count, middleware.FailedQueue)) {
+					fmt.Fprintln(cmd.OutOrStdout(), "Aborted.")
+					return nil
+				}
+				n, err := in.Purge()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Purged %d job(s).\n", n)
+				return nil
+			})
+		},
+	}
+	purge.Flags().BoolVarP(&yes, "yes", "y", false, "do not ask for confirmation")
+
+	cmd.AddCommand(list, show, replay, purge)
+	return cmd
+}
+
+// withInspector connects to RabbitMQ for the duration of fn. Closing the connection returns the
+// messages fn fetched but did not replay to the queue.
+func withInspector(fn func(in *dlq.Inspector) error) error {
+	c, err := internals.LoadBroker(nil)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	conn, err := amqp.Dial(c.RabbitMQURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	publisher, err := middleware.NewConfirmPublisher(conn, 1, c.PublishConfirmTimeout)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	return fn(dlq.NewInspector(ch, publisher, c))
+}
+
+// searched notes the search limit in "not found" messages, since the job may lie beyond it.
+func searched(limit int) string {
+	if limit == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (searched the first %d messages; raise --limit to search further)", limit)
+}
+
+func printList(w io.Writer, msgs []dlq.Message) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REQUEST ID\tCORRELATION ID\tUSER\tRETRIES\tDEAD-LETTERED\tREASON")
+	for _, m := range msgs {
+		if m.ParseErr != nil {
+			fmt.Fprintf(tw, "-\t-\t-\t-\t%s\tinvalid job: %v\n", when(deadLettered(m)), m.ParseErr)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", m.Job.RequestID, orDash(m.Job.CorrelationID), m.Job.UserID, m.Job.RetryCount, when(deadLettered(m)), reason(m))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d job(s)\n", len(msgs))
+}
+
+func printMessage(w io.Writer, m dlq.Message) {
+	if f := m.Failure; f.Reason != "" {
+		fmt.Fprintf(w, "Dead-lettered: %s by %s (%s)\n", when(f.LastAttempt), orDash(f.WorkerID), reason(m))
+		fmt.Fprintf(w, "Attempts: %d since %s\n", f.Attempts, when(f.FirstSeen))
+		fmt.Fprintf(w, "Last error: %s\n", orDash(f.LastError))
+	} else {
+		fmt.Fprintf(w, "Dead-lettered: %s from %s (%s, %d time(s))\n", when(m.Death.Time), orDash(m.Death.Queue), reason(m), m.Death.Count)
+	}
+	fmt.Fprintln(w, "Headers:")
+	for _, k := range slices.Sorted(maps.Keys(m.Headers)) {
+		if k == "x-death" {
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %v\n", k, m.Headers[k])
+	}
+	fmt.Fprintln(w, "Body:")
+	var pretty json.RawMessage = m.Body
+	if out, err := json.MarshalIndent(pretty, "  ", "  "); err == nil {
+		fmt.Fprintf(w, "  %s\n", out)
+	} else {
+		fmt.Fprintf(w, "  %s\n", m.Body)
+	}
+}
+
+// reason prefers the worker's failure headers; messages without them were dead-lettered by RabbitMQ.
+func reason(m dlq.Message) string {
+	if f := m.Failure; f.Reason != "" {
+		if f.Class == "" {
+			return f.Reason
+		}
+		return fmt.Sprintf("%s (%s)", f.Reason, f.Class)
+	}
+	return orDash(m.Death.Reason)
+}
+
+func deadLettered(m dlq.Message) time.Time {
+	if !m.Failure.LastAttempt.IsZero() {
+		return m.Failure.LastAttempt
+	}
+	return m.Death.Time
+}
+
+func when(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprint(out, prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
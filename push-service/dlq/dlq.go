@@ -0,0 +1,232 @@
+// Package dlq inspects and replays the jobs that ended up in the dead-letter queue (failed.queue).
+package dlq
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ezrahel/middleware"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// Channel is the part of *amqp.Channel the inspector uses.
+type Channel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+// Death is RabbitMQ's record of why and where a message was dead-lettered (the x-death header).
+type Death struct {
+	Reason string // rejected, expired or maxlen
+	Queue  string // Queue the message was dead-lettered from
+	Time   time.Time
+	Count  int64 // How many times it was dead-lettered from that queue for that reason
+}
+
+// Failure is the worker's record of why it dead-lettered a job (the middleware.Header* headers).
+// It is empty for messages RabbitMQ dead-lettered on its own; Death describes those.
+type Failure struct {
+	Reason      string // One of the middleware.Failure* values
+	Class       models.ErrorClass
+	LastError   string
+	Attempts    int64
+	FirstSeen   time.Time
+	LastAttempt time.Time
+	WorkerID    string
+}
+
+// Message is one dead-lettered job.
+type Message struct {
+	Job      models.PushNotificationJob
+	ParseErr error // Set when the body is not a valid job; Job is then empty
+	Body     []byte
+	Headers  amqp.Table
+	Death    Death
+	Failure  Failure
+
+	delivery amqp.Delivery
+}
+
+// Inspector reads, replays and purges the DLQ.
+//
+// Fetched messages stay unacknowledged until they are replayed, so they are invisible to other
+// readers meanwhile. Closing the channel hands the ones that were not replayed back to the queue.
+type Inspector struct {
+	ch  Channel
+	pub middleware.Publisher
+	cfg middleware.Config
+}
+
+// NewInspector creates an inspector for cfg's DLQ; replays go through pub.
+func NewInspector(ch Channel, pub middleware.Publisher, cfg middleware.Config) *Inspector {
+	return &Inspector{ch: ch, pub: pub, cfg: cfg}
+}
+
+// Count returns the number of messages waiting in the DLQ.
+func (in *Inspector) Count() (int, error) {
+	q, err := in.ch.QueueInspect(middleware.FailedQueue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect %s: %w", middleware.FailedQueue, err)
+	}
+	return q.Messages, nil
+}
+
+// Fetch reads up to limit messages from the DLQ, or all of them when limit is 0.
+func (in *Inspector) Fetch(limit int) ([]Message, error) {
+	var msgs []Message
+	for limit == 0 || len(msgs) < limit {
+		m, ok, err := in.next()
+		if err != nil || !ok {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Search reads the DLQ until it has come across every job in ids, or has read limit messages
+// (0 for no limit). It returns the first message of each job it found, and the IDs it did not find.
+func (in *Inspector) Search(ids []string, limit int) (found []Message, missing []string, err error) {
+	pending := map[string]bool{}
+	for _, id := range ids {
+		pending[id] = true
+	}
+	for read := 0; len(pending) > 0 && (limit == 0 || read < limit); read++ {
+		var m Message
+		var ok bool
+		if m, ok, err = in.next(); err != nil || !ok {
+			break
+		}
+		if m.ParseErr == nil && pending[m.Job.RequestID] {
+			found = append(found, m)
+			delete(pending, m.Job.RequestID)
+		}
+	}
+	for _, id := range ids {
+		if pending[id] {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing, err
+}
+
+// next reads one message from the DLQ; ok is false once the queue is empty.
+func (in *Inspector) next() (m Message, ok bool, err error) {
+	d, ok, err := in.ch.Get(middleware.FailedQueue, false)
+	if err != nil {
+		return Message{}, false, fmt.Errorf("failed to read %s: %w", middleware.FailedQueue, err)
+	}
+	if !ok {
+		return Message{}, false, nil
+	}
+	return newMessage(d), true, nil
+}
+
+func newMessage(d amqp.Delivery) Message {
+	m := Message{Body: d.Body, Headers: d.Headers, Death: lastDeath(d.Headers), Failure: failure(d.Headers), delivery: d}
+	if err := json.Unmarshal(d.Body, &m.Job); err != nil {
+		m.ParseErr = err
+	}
+	return m
+}
+
+// lastDeath returns the most recent x-death entry. RabbitMQ puts it first.
+func lastDeath(headers amqp.Table) Death {
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return Death{}
+	}
+	entry, _ := deaths[0].(amqp.Table)
+	var death Death
+	death.Reason, _ = entry["reason"].(string)
+	death.Queue, _ = entry["queue"].(string)
+	death.Time, _ = entry["time"].(time.Time)
+	death.Count, _ = entry["count"].(int64)
+	return death
+}
+
+func failure(headers amqp.Table) Failure {
+	var f Failure
+	f.Reason, _ = headers[middleware.HeaderFailureReason].(string)
+	class, _ := headers[middleware.HeaderFailureClass].(string)
+	f.Class = models.ErrorClass(class)
+	f.LastError, _ = headers[middleware.HeaderLastError].(string)
+	f.Attempts, _ = headers[middleware.HeaderAttempts].(int64)
+	f.FirstSeen = timestamp(headers[middleware.HeaderFirstSeen])
+	f.LastAttempt = timestamp(headers[middleware.HeaderLastAttempt])
+	f.WorkerID, _ = headers[middleware.HeaderWorkerID].(string)
+	return f
+}
+
+func timestamp(v interface{}) time.Time {
+	s, _ := v.(string)
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// Find returns the messages whose request ID is in ids, and the IDs that were not found.
+func Find(msgs []Message, ids []string) (found []Message, missing []string) {
+	for _, id := range ids {
+		var ok bool
+		for _, m := range msgs {
+			if m.ParseErr == nil && m.Job.RequestID == id {
+				found = append(found, m)
+				ok = true
+			}
+		}
+		if !ok {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
+}
+
+// Replay publishes each job back to the push queue with its retry count reset, and removes it from
+// the DLQ once the broker has confirmed the copy. The copy keeps the job's trace context headers,
+// so the replay shows up in the original trace, but none of the failure or x-death headers. It stops at the first failure and returns how many
+// were replayed. Messages that are not valid jobs cannot be replayed and are skipped.
+func (in *Inspector) Replay(msgs []Message) (int, error) {
+	replayed := 0
+	for _, m := range msgs {
+		if m.ParseErr != nil {
+			continue
+		}
+		job := m.Job
+		job.RetryCount = 0
+		body, err := json.Marshal(job)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to marshal %s: %w", job.RequestID, err)
+		}
+
+		err = in.pub.Publish(in.cfg.ExchangeName, in.cfg.QueueName, false, false, amqp.Publishing{
+			ContentType:   "application/json",
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: job.CorrelationID,
+			Headers:       middleware.TraceHeaders(m.Headers),
+			Body:          body,
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("failed to replay %s: %w", job.RequestID, err)
+		}
+		if err := m.delivery.Ack(false); err != nil {
+			// The copy is on push.queue already; the original comes back to the DLQ as a duplicate,
+			// which the worker's idempotency check turns into a no-op if replayed again.
+			return replayed + 1, fmt.Errorf("replayed %s but failed to remove it from %s: %w", job.RequestID, middleware.FailedQueue, err)
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Purge deletes every message in the DLQ and returns how many were deleted. Messages fetched
+// through this inspector and not yet replayed are not affected; they return to the queue on close.
+func (in *Inspector) Purge() (int, error) {
+	n, err := in.ch.QueuePurge(middleware.FailedQueue, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge %s: %w", middleware.FailedQueue, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,242 @@
+package dlq
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/middleware"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// fakeQueue serves deliveries like basic.get and records what happened to each one.
+type fakeQueue struct {
+	deliveries []amqp.Delivery
+	next       int
+	acked      map[uint64]bool
+	purged     bool
+}
+
+func (q *fakeQueue) Ack(tag uint64, multiple bool) error {
+	q.acked[tag] = true
+	return nil
+}
+func (q *fakeQueue) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (q *fakeQueue) Reject(tag uint64, requeue bool) error         { return nil }
+
+func (q *fakeQueue) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if q.next == len(q.deliveries) {
+		return amqp.Delivery{}, false, nil
+	}
+	q.next++
+	return q.deliveries[q.next-1], true, nil
+}
+
+func (q *fakeQueue) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: len(q.deliveries) - q.next}, nil
+}
+
+func (q *fakeQueue) QueuePurge(name string, noWait bool) (int, error) {
+	q.purged = true
+	return len(q.deliveries) - q.next, nil
+}
+
+type fakePublisher struct {
+	published []amqp.Publishing
+	keys      []string
+	err       error
+}
+
+func (p *fakePublisher) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.keys = append(p.keys, key)
+	p.published = append(p.published, msg)
+	return nil
+}
+
+var deadAt = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newFakeQueue(bodies ...string) *fakeQueue {
+	q := &fakeQueue{acked: map[uint64]bool{}}
+	for i, body := range bodies {
+		q.deliveries = append(q.deliveries, amqp.Delivery{
+			Acknowledger: q,
+			DeliveryTag:  uint64(i + 1),
+			Body:         []byte(body),
+			Headers: amqp.Table{"x-death": []interface{}{
+				amqp.Table{"reason": "rejected", "queue": "push.queue", "time": deadAt, "count": int64(1)},
+			}},
+		})
+	}
+	return q
+}
+
+func newTestInspector(q *fakeQueue, pub *fakePublisher) *Inspector {
+	return NewInspector(q, pub, middleware.Config{ExchangeName: "notifications.direct", QueueName: "push.queue"})
+}
+
+func TestFetchParsesJobsAndDeath(t *testing.T) {
+	q := newFakeQueue(
+		`{"request_id":"r-1","correlation_id":"c-1","user_id":"u-1","retry_count":5}`,
+		`not json`,
+		`{"request_id":"r-3"}`,
+	)
+	msgs, err := newTestInspector(q, &fakePublisher{}).Fetch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("fetched %d messages, want the limit of 2", len(msgs))
+	}
+	if msgs[0].Job.RequestID != "r-1" || msgs[0].Job.CorrelationID != "c-1" || msgs[0].Job.RetryCount != 5 {
+		t.Errorf("job = %+v", msgs[0].Job)
+	}
+	want := Death{Reason: "rejected", Queue: "push.queue", Time: deadAt, Count: 1}
+	if msgs[0].Death != want {
+		t.Errorf("death = %+v, want %+v", msgs[0].Death, want)
+	}
+	if msgs[1].ParseErr == nil {
+		t.Error("invalid body parsed without error")
+	}
+}
+
+func TestFetchParsesFailureHeaders(t *testing.T) {
+	q := newFakeQueue(`{"request_id":"r-1"}`)
+	q.deliveries[0].Headers = amqp.Table{
+		middleware.HeaderFailureReason: middleware.FailureDelivery,
+		middleware.HeaderFailureClass:  "permanent",
+		middleware.HeaderLastError:     "fcm: invalid argument",
+		middleware.HeaderAttempts:      int64(2),
+		middleware.HeaderFirstSeen:     "2025-03-01T11:00:00Z",
+		middleware.HeaderLastAttempt:   "2025-03-01T12:00:00Z",
+		middleware.HeaderWorkerID:      "push-7f9c",
+	}
+	msgs, err := newTestInspector(q, &fakePublisher{}).Fetch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Failure{
+		Reason:      middleware.FailureDelivery,
+		Class:       models.ErrorClassPermanent,
+		LastError:   "fcm: invalid argument",
+		Attempts:    2,
+		FirstSeen:   deadAt.Add(-time.Hour),
+		LastAttempt: deadAt,
+		WorkerID:    "push-7f9c",
+	}
+	if msgs[0].Failure != want {
+		t.Errorf("failure = %+v, want %+v", msgs[0].Failure, want)
+	}
+}
+
+func TestSearchStopsOnceEveryJobIsFound(t *testing.T) {
+	q := newFakeQueue(`{"request_id":"r-1"}`, `{"request_id":"r-2"}`, `not json`, `{"request_id":"r-3"}`)
+	in := newTestInspector(q, &fakePublisher{})
+
+	found, missing, err := in.Search([]string{"r-2", "r-1"}, 0)
+	if err != nil || len(found) != 2 || len(missing) != 0 {
+		t.Fatalf("Search = %d found, missing %v, %v", len(found), missing, err)
+	}
+	if q.next != 2 {
+		t.Errorf("read %d messages, want to stop at the last job searched for", q.next)
+	}
+
+	found, missing, _ = in.Search([]string{"r-3"}, 1)
+	if len(found) != 0 || len(missing) != 1 || missing[0] != "r-3" || q.next != 3 {
+		t.Errorf("Search past the limit = %d found, missing %v after %d reads", len(found), missing, q.next)
+	}
+}
+
+func TestReplayResetsRetryCount(t *testing.T) {
+	q := newFakeQueue(
+		`{"request_id":"r-1","correlation_id":"c-1","retry_count":5}`,
+		`{"request_id":"r-2","retry_count":5}`,
+		`not json`,
+	)
+	pub := &fakePublisher{}
+	in := newTestInspector(q, pub)
+	msgs, _ := in.Fetch(0)
+
+	selected, missing := Find(msgs, []string{"r-1", "r-9"})
+	if len(selected) != 1 || len(missing) != 1 || missing[0] != "r-9" {
+		t.Fatalf("Find = %d found, missing %v", len(selected), missing)
+	}
+	n, err := in.Replay(selected)
+	if err != nil || n != 1 {
+		t.Fatalf("Replay = %d, %v", n, err)
+	}
+
+	var job models.PushNotificationJob
+	json.Unmarshal(pub.published[0].Body, &job)
+	if pub.keys[0] != "push.queue" || job.RequestID != "r-1" || job.RetryCount != 0 {
+		t.Errorf("replayed %+v to %s, want r-1 with retry count 0 to push.queue", job, pub.keys[0])
+	}
+	if pub.published[0].DeliveryMode != amqp.Persistent || pub.published[0].CorrelationId != "c-1" {
+		t.Errorf("publishing = %+v", pub.published[0])
+	}
+	if !q.acked[1] || q.acked[2] || q.acked[3] {
+		t.Errorf("acked %v, want only the replayed message removed", q.acked)
+	}
+}
+
+func TestReplayKeepsOnlyTraceHeaders(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	q := newFakeQueue(`{"request_id":"r-1"}`, `{"request_id":"r-2"}`)
+	q.deliveries[0].Headers = amqp.Table{
+		"traceparent":                  traceparent,
+		"tracestate":                   "vendor=abc",
+		"baggage":                      "tenant=acme",
+		"x-death":                      q.deliveries[0].Headers["x-death"],
+		middleware.HeaderFailureReason: middleware.FailureDelivery,
+		middleware.HeaderFailureClass:  "transient",
+		middleware.HeaderLastError:     "fcm unavailable",
+		middleware.HeaderAttempts:      int64(6),
+		middleware.HeaderFirstSeen:     "2025-03-01T11:00:00Z",
+		middleware.HeaderLastAttempt:   "2025-03-01T12:00:00Z",
+		middleware.HeaderWorkerID:      "push-7f9c",
+	}
+	pub := &fakePublisher{}
+	in := newTestInspector(q, pub)
+	msgs, _ := in.Fetch(0)
+	if _, err := in.Replay(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := amqp.Table{"traceparent": traceparent, "tracestate": "vendor=abc", "baggage": "tenant=acme"}
+	if got := pub.published[0].Headers; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay headers = %v, want only %v", got, want)
+	}
+	if got := pub.published[1].Headers; len(got) != 0 {
+		t.Errorf("replay headers of an untraced job = %v, want none", got)
+	}
+}
+
+func TestReplayKeepsMessageWhenPublishFails(t *testing.T) {
+	q := newFakeQueue(`{"request_id":"r-1"}`)
+	in := newTestInspector(q, &fakePublisher{err: errors.New("nacked")})
+	msgs, _ := in.Fetch(0)
+
+	if n, err := in.Replay(msgs); err == nil || n != 0 {
+		t.Fatalf("Replay = %d, %v; want an error", n, err)
+	}
+	if q.acked[1] {
+		t.Error("message removed from the DLQ although the replay was not confirmed")
+	}
+}
+
+func TestCountAndPurge(t *testing.T) {
+	q := newFakeQueue(`{"request_id":"r-1"}`, `{"request_id":"r-2"}`)
+	in := newTestInspector(q, &fakePublisher{})
+
+	if n, _ := in.Count(); n != 2 {
+		t.Errorf("Count = %d, want 2", n)
+	}
+	if n, err := in.Purge(); err != nil || n != 2 || !q.purged {
+		t.Errorf("Purge = %d, %v", n, err)
+	}
+}
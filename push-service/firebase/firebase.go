@@ -1,2 +1,197 @@
 package firebase
 
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	fb "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+
+	"github.com/ezrahel/models"
+)
+
+// ProviderName is the name the FCM provider is registered under.
+const ProviderName = "fcm"
+
+// quotaBackoff is how long to wait after a quota-exceeded response without a Retry-After header.
+// FCM asks for a minimum initial delay of one minute in that case.
+const quotaBackoff = time.Minute
+
+// firebaseScopes are the OAuth2 scopes the messaging client needs.
+var firebaseScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/firebase.messaging",
+}
+
+// Provider delivers push notifications through Firebase Cloud Messaging.
+type Provider struct {
+	client *messaging.Client
+	hints  *retryAfterTransport // Nil when the HTTP client was not built by NewProvider
+}
+
+// NewProvider initializes the Firebase App from a service account file and returns an FCM provider.
+// With an empty credentialsPath, Application Default Credentials are used.
+func NewProvider(ctx context.Context, credentialsPath string) (*Provider, error) {
+	var creds []option.ClientOption
+	if credentialsPath != "" {
+		creds = append(creds, option.WithCredentialsFile(credentialsPath))
+	}
+
+	// The SDK errors carry no response headers, so the authorized client is wrapped to see Retry-After.
+	hc, _, err := htransport.NewClient(ctx, append(creds, option.WithScopes(firebaseScopes...))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FCM HTTP client: %w", err)
+	}
+	hints := &retryAfterTransport{base: hc.Transport}
+	hc.Transport = hints
+
+	app, err := fb.NewApp(ctx, nil, append(creds, option.WithHTTPClient(hc))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Firebase App: %w", err)
+	}
+
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FCM client: %w", err)
+	}
+	return &Provider{client: client, hints: hints}, nil
+}
+
+// NewProviderWithClient wraps an already initialized FCM client. Without access to the HTTP
+// responses, RetryAfter falls back to FCM's documented minimum delays.
+func NewProviderWithClient(client *messaging.Client) *Provider {
+	return &Provider{client: client}
+}
+
+// Name implements middleware.PushProvider.
+func (p *Provider) Name() string { return ProviderName }
+
+// Send delivers one message using the Firebase Admin SDK and returns the FCM message ID.
+func (p *Provider) Send(ctx context.Context, msg models.PushMessage) (string, error) {
+	response, err := p.client.Send(ctx, toFCMMessage(msg))
+	if err != nil {
+		// The SDK helpers (IsRegistrationTokenNotRegistered, ...) type-assert the error,
+		// so it is returned unwrapped for ClassifyError to inspect.
+		return "", err
+	}
+	return response, nil
+}
+
+// SendBatch delivers each message individually. The legacy FCM batch endpoint used by
+// SendAll has been retired, so messages are sent one request at a time.
+func (p *Provider) SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error) {
+	results := make([]models.SendResult, len(msgs))
+	for i, msg := range msgs {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		id, err := p.Send(ctx, msg)
+		results[i] = models.SendResult{Token: msg.Token, MessageID: id, Error: err}
+	}
+	return results, nil
+}
+
+// ClassifyError maps FCM error codes to the worker's failure classes.
+func (p *Provider) ClassifyError(err error) models.ErrorClass {
+	switch {
+	case err == nil:
+		return ""
+	case messaging.IsRegistrationTokenNotRegistered(err),
+		messaging.IsInvalidArgument(err),
+		messaging.IsMismatchedCredential(err):
+		// Token unregistered, malformed request, or token belongs to another sender.
+		return models.ErrorClassPermanent
+	case messaging.IsMessageRateExceeded(err):
+		return models.ErrorClassThrottled
+	default:
+		// unavailable, internal, unknown, APNs credential problems and network errors.
+		return models.ErrorClassTransient
+	}
+}
+
+// IsTokenInvalid reports FCM's "registration-token-not-registered" errors, which FCM returns for
+// uninstalled apps and stale tokens, and "invalid-argument" errors about the registration token.
+// FCM also answers invalid-argument for bad payloads (an image URL, a TTL, reserved data keys);
+// those are the template's fault and must not get every recipient's token deleted.
+func (p *Provider) IsTokenInvalid(err error) bool {
+	if messaging.IsRegistrationTokenNotRegistered(err) {
+		return true
+	}
+	// The SDK only keeps FCM's message, e.g. "The registration token is not a valid FCM registration token".
+	return messaging.IsInvalidArgument(err) && strings.Contains(strings.ToLower(err.Error()), "registration token")
+}
+
+// RetryAfter returns how long FCM asked us to back off after a quota-exceeded or unavailable error:
+// the Retry-After of the latest 429/503 response, or one minute for quota errors without one.
+func (p *Provider) RetryAfter(err error) time.Duration {
+	var hint time.Duration
+	if p.hints != nil {
+		hint = p.hints.wait()
+	}
+	switch {
+	case messaging.IsMessageRateExceeded(err):
+		return max(hint, quotaBackoff)
+	case messaging.IsServerUnavailable(err):
+		return hint
+	default:
+		return 0
+	}
+}
+
+// retryAfterTransport records the Retry-After header of 429 and 503 responses from FCM.
+type retryAfterTransport struct {
+	base http.RoundTripper
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+
+	now := time.Now()
+	until := now.Add(models.ParseRetryAfter(resp.Header.Get("Retry-After"), now))
+
+	t.mu.Lock()
+	if until.After(t.blockedUntil) {
+		t.blockedUntil = until
+	}
+	t.mu.Unlock()
+	return resp, nil
+}
+
+// wait returns how much of the last Retry-After is left.
+func (t *retryAfterTransport) wait() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return max(time.Until(t.blockedUntil), 0)
+}
+
+// toFCMMessage builds the FCM payload for a single device token.
+func toFCMMessage(msg models.PushMessage) *messaging.Message {
+	data := map[string]string{
+		"link_url": msg.LinkURL, // Send link as data for custom app handling
+	}
+	for k, v := range msg.Data {
+		data[k] = v
+	}
+
+	return &messaging.Message{
+		Notification: &messaging.Notification{
+			Title:    msg.Title,
+			Body:     msg.Body,
+			ImageURL: msg.ImageURL,
+		},
+		Data:  data,
+		Token: msg.Token, // Target the specific device token
+	}
+}
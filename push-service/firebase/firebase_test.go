@@ -0,0 +1,148 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	fb "firebase.google.com/go"
+	"google.golang.org/api/option"
+
+	"github.com/ezrahel/models"
+)
+
+// stubTransport answers every FCM request with a canned response.
+type stubTransport struct {
+	status     int
+	body       string
+	retryAfter string
+}
+
+func (s stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if s.retryAfter != "" {
+		header.Set("Retry-After", s.retryAfter)
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(s.body)),
+		Request:    r,
+	}, nil
+}
+
+func newStubProvider(t *testing.T, status int, body string) *Provider {
+	t.Helper()
+	return newProviderWithTransport(t, stubTransport{status: status, body: body})
+}
+
+// newProviderWithTransport builds the provider the way NewProvider does, minus the credentials.
+func newProviderWithTransport(t *testing.T, base http.RoundTripper) *Provider {
+	t.Helper()
+	ctx := context.Background()
+	hints := &retryAfterTransport{base: base}
+	app, err := fb.NewApp(ctx, &fb.Config{ProjectID: "test-project"},
+		option.WithHTTPClient(&http.Client{Transport: hints}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Provider{client: client, hints: hints}
+}
+
+func fcmError(status, code string) string {
+	return fcmErrorWithMessage(status, code, "test")
+}
+
+func fcmErrorWithMessage(status, code, message string) string {
+	return `{"error":{"status":"` + status + `","message":"` + message + `","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"` + code + `"}]}}`
+}
+
+func TestClassifyFCMErrors(t *testing.T) {
+	// 500 and 503 are left out: the SDK retries those itself with backoff.
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantClass    models.ErrorClass
+		tokenInvalid bool
+	}{
+		{"unregistered", http.StatusNotFound, fcmError("NOT_FOUND", "UNREGISTERED"), models.ErrorClassPermanent, true},
+		{"invalid token", http.StatusBadRequest, fcmErrorWithMessage("INVALID_ARGUMENT", "INVALID_ARGUMENT", "The registration token is not a valid FCM registration token"), models.ErrorClassPermanent, true},
+		{"invalid payload", http.StatusBadRequest, fcmErrorWithMessage("INVALID_ARGUMENT", "INVALID_ARGUMENT", "Invalid value at 'message.android.ttl', Illegal duration format"), models.ErrorClassPermanent, false},
+		{"sender id mismatch", http.StatusForbidden, fcmError("PERMISSION_DENIED", "SENDER_ID_MISMATCH"), models.ErrorClassPermanent, false},
+		{"quota exceeded", http.StatusTooManyRequests, fcmError("RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED"), models.ErrorClassThrottled, false},
+		{"apns auth error", http.StatusUnauthorized, fcmError("UNAUTHENTICATED", "THIRD_PARTY_AUTH_ERROR"), models.ErrorClassTransient, false},
+		{"unknown", http.StatusBadGateway, `not json`, models.ErrorClassTransient, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStubProvider(t, tt.status, tt.body)
+			_, err := p.Send(context.Background(), models.PushMessage{Token: "token", Title: "t", Body: "b"})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := p.ClassifyError(err); got != tt.wantClass {
+				t.Errorf("ClassifyError = %s, want %s (%v)", got, tt.wantClass, err)
+			}
+			if got := p.IsTokenInvalid(err); got != tt.tokenInvalid {
+				t.Errorf("IsTokenInvalid = %t, want %t", got, tt.tokenInvalid)
+			}
+		})
+	}
+}
+
+func TestRetryAfterFromQuotaErrors(t *testing.T) {
+	quota := fcmError("RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED")
+	tests := []struct {
+		name       string
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{"header", "120", 119 * time.Second, 120 * time.Second},
+		{"short header keeps the documented minimum", "5", time.Minute, time.Minute},
+		{"no header", "", time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newProviderWithTransport(t, stubTransport{status: http.StatusTooManyRequests, body: quota, retryAfter: tt.retryAfter})
+			_, err := p.Send(context.Background(), models.PushMessage{Token: "token"})
+			if got := p.RetryAfter(err); got < tt.min || got > tt.max {
+				t.Errorf("RetryAfter = %s, want between %s and %s", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryAfterIsZeroForOtherErrors(t *testing.T) {
+	p := newProviderWithTransport(t, stubTransport{status: http.StatusNotFound, body: fcmError("NOT_FOUND", "UNREGISTERED")})
+	_, err := p.Send(context.Background(), models.PushMessage{Token: "token"})
+	if got := p.RetryAfter(err); got != 0 {
+		t.Errorf("RetryAfter = %s, want 0", got)
+	}
+}
+
+func TestClassifyNetworkErrorIsTransient(t *testing.T) {
+	p := &Provider{}
+	if got := p.ClassifyError(errors.New("connection reset by peer")); got != models.ErrorClassTransient {
+		t.Errorf("ClassifyError = %s, want transient", got)
+	}
+}
+
+func TestSendReturnsMessageID(t *testing.T) {
+	p := newStubProvider(t, http.StatusOK, `{"name":"projects/test-project/messages/123"}`)
+	id, err := p.Send(context.Background(), models.PushMessage{Token: "token", Title: "t", Body: "b"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if id != "projects/test-project/messages/123" {
+		t.Errorf("id = %q", id)
+	}
+}
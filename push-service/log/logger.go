@@ -1 +1,55 @@
+// Package log is the push service's structured, leveled logger, a thin layer over log/slog.
+// Lines are JSON in production and text for local development, and every line about a job carries
+// the job's correlation, request and user IDs.
 package log
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/ezrahel/models"
+)
+
+// Output formats (LOG_FORMAT).
+const (
+	FormatJSON = "json" // One object per line, for log shipping
+	FormatText = "text" // key=value, easier to read in a terminal
+)
+
+// Field names bound to every line logged about a job.
+const (
+	CorrelationID = "correlation_id"
+	RequestID     = "request_id"
+	UserID        = "user_id"
+)
+
+// New returns a logger writing to w in format that drops lines below level. Pass a *slog.LevelVar
+// to change the level while running.
+func New(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == FormatText {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// ParseLevel parses debug, info, warn or error, in any case.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// ForJob binds the job's IDs to l, so lines about the job can be found by any of them.
+func ForJob(l *slog.Logger, job models.PushNotificationJob) *slog.Logger {
+	return l.With(CorrelationID, job.CorrelationID, RequestID, job.RequestID, UserID, job.UserID)
+}
+
+// Err is the attribute for an error.
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
@@ -0,0 +1,56 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+)
+
+func TestForJobBindsJobFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := ForJob(New(&buf, FormatJSON, slog.LevelInfo), models.PushNotificationJob{
+		CorrelationID: "c-1", RequestID: "r-1", UserID: "u-1",
+	})
+	logger.Warn("Delivery failed", Err(errors.New("fcm unavailable")))
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("not JSON: %s", buf.String())
+	}
+	want := map[string]any{
+		"level": "WARN", "msg": "Delivery failed", "error": "fcm unavailable",
+		CorrelationID: "c-1", RequestID: "r-1", UserID: "u-1",
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+}
+
+func TestNewDropsLinesBelowLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatText, slog.LevelWarn)
+	logger.Info("hidden")
+	logger.Warn("shown")
+
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "msg=shown") {
+		t.Errorf("output = %q, want only the warning as text", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, " warn ": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLevel(in); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+}
@@ -2,135 +2,234 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	firebase "firebase.google.com/go"
-	// "firebase.google.com/go/messaging"
+	pushfirebase "github.com/ezrahel/firebase"
+	"github.com/ezrahel/apns"
+	"github.com/ezrahel/internals"
+	"github.com/ezrahel/log"
+	"github.com/ezrahel/middleware"
+	"github.com/ezrahel/onesignal"
+	"github.com/ezrahel/webpush"
 	"github.com/go-redis/redis/v8"
 	"github.com/streadway/amqp"
-	"google.golang.org/api/option"
-	"github.com/ezrahel/middleware"
 )
 
+// abortGrace is how long shutdown waits, after a timed-out drain, for the aborted jobs to requeue
+// their deliveries and release their leases.
+const abortGrace = 5 * time.Second
+
 func main() {
 	// --- Load Configuration ---
-	cfg := middleware.LoadConfig()
+	// Defaults, then the YAML file (--config or PUSH_CONFIG_FILE), the environment and flags.
+	loader := internals.NewLoader(os.Args[1:])
+	cfg, err := loader.Load()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
 	cfg.Print() // Log configuration at startup
 	ctx := context.Background()
 
+	// Structured logger: JSON in production, text locally (LOG_FORMAT), level from LOG_LEVEL.
+	// The level is a LevelVar so a configuration reload can change it.
+	var logLevel slog.LevelVar
+	logLevel.Set(cfg.LogLevel)
+	logger := log.New(os.Stdout, cfg.LogFormat, &logLevel)
+	slog.SetDefault(logger)
+
+	// Tracing: W3C trace context is read from and written to AMQP headers; spans are exported
+	// over OTLP, printed on stdout, or dropped (TRACING_EXPORTER).
+	shutdownTracing, err := middleware.SetupTracing(ctx, cfg)
+	if err != nil {
+		logger.Error("Failed to set up tracing. Exiting.", log.Err(err))
+		os.Exit(1)
+	}
+	flushTraces := func() {
+		flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Warn("Failed to flush traces.", log.Err(err))
+		}
+	}
+
 	// --- 1. Connect to Redis ---
 	rdb := redis.NewClient(&redis.Options{
 		Addr: cfg.RedisAddr,
 	})
 
 	if _, err := rdb.Ping(ctx).Result(); err != nil {
-		fmt.Printf("Could not connect to Redis: %v. Exiting.\n", err)
+		logger.Error("Could not connect to Redis. Exiting.", log.Err(err))
 		os.Exit(1)
 	}
-	fmt.Println("Connected to Redis successfully.")
+	logger.Info("Connected to Redis successfully.")
 
-	// --- 2. Initialize Firebase FCM Client ---
-	// Authentication is handled via the credentials path specified in config.go
-	opt := option.WithCredentialsFile(cfg.FirebaseCredentialsPath)
-	app, err := firebase.NewApp(ctx, nil, opt)
-	if err != nil {
-		fmt.Printf("Failed to initialize Firebase App: %v. Check FIREBASE_CREDENTIALS_PATH.\n", err)
-		os.Exit(1)
-	}
-	
-	fcmClient, err := app.Messaging(ctx)
+	// --- 2. Initialize Push Provider (Firebase FCM) ---
+	// Authentication uses FIREBASE_CREDENTIALS_PATH, or Application Default Credentials when unset.
+	fcmProvider, err := pushfirebase.NewProvider(ctx, cfg.FirebaseCredentialsPath)
 	if err != nil {
-		fmt.Printf("Failed to get FCM client: %v. Exiting.\n", err)
+		logger.Error("Failed to initialize FCM provider. Check FIREBASE_CREDENTIALS_PATH.", log.Err(err))
 		os.Exit(1)
 	}
-	fmt.Println("Firebase FCM client initialized successfully.")
-	
+	logger.Info("Firebase FCM provider initialized successfully.")
 
-	// --- 3. Connect to RabbitMQ ---
-	conn, err := amqp.Dial(cfg.RabbitMQURL)
-	if err != nil {
-		fmt.Printf("Failed to connect to RabbitMQ: %v. Exiting.\n", err)
-		os.Exit(1)
+	// Optional native APNs provider for iOS devices (token-based .p8 auth).
+	var apnsProvider *apns.Provider
+	if cfg.APNSKeyPath != "" {
+		key, err := apns.LoadPrivateKey(cfg.APNSKeyPath)
+		if err != nil {
+			logger.Error("Failed to load APNs key. Check APNS_KEY_PATH.", log.Err(err))
+			os.Exit(1)
+		}
+		apnsProvider, err = apns.NewProvider(apns.Config{
+			KeyID:      cfg.APNSKeyID,
+			TeamID:     cfg.APNSTeamID,
+			Topic:      cfg.APNSTopic,
+			PrivateKey: key,
+			Production: cfg.APNSProduction,
+			BaseURL:    cfg.APNSBaseURL,
+		})
+		if err != nil {
+			logger.Error("Failed to initialize APNs provider. Exiting.", log.Err(err))
+			os.Exit(1)
+		}
+		logger.Info("APNs provider initialized successfully.")
 	}
-	// Defer closing connection only after consumer is established
-	defer conn.Close()
 
-	ch, err := conn.Channel()
-	if err != nil {
-		fmt.Printf("Failed to open a channel: %v. Exiting.\n", err)
-		os.Exit(1)
+	// Optional self-hosted Web Push provider for browser subscriptions.
+	var webPushProvider *webpush.Provider
+	if cfg.VAPIDPrivateKey != "" {
+		webPushProvider, err = webpush.NewProvider(webpush.Config{
+			PublicKey:  cfg.VAPIDPublicKey,
+			PrivateKey: cfg.VAPIDPrivateKey,
+			Subject:    cfg.VAPIDSubject,
+		})
+		if err != nil {
+			logger.Error("Failed to initialize Web Push provider. Check VAPID_* settings.", log.Err(err))
+			os.Exit(1)
+		}
+		logger.Info("Web Push (VAPID) provider initialized successfully.")
 	}
-	defer ch.Close()
 
-	// --- 4. Declare Topology (RabbitMQ Setup) ---
-	
-	// Declare main exchange (notifications.direct)
-	err = ch.ExchangeDeclare(cfg.ExchangeName, "direct", true, false, false, false, nil)
-	if err != nil {
-		fmt.Printf("Failed to declare exchange: %v. Exiting.\n", err)
-		os.Exit(1)
+	// Optional OneSignal provider, selected per job or per user.
+	var oneSignalProvider *onesignal.Provider
+	if cfg.OneSignalAppID != "" {
+		oneSignalProvider, err = onesignal.NewProvider(onesignal.Config{
+			AppID:   cfg.OneSignalAppID,
+			APIKey:  cfg.OneSignalAPIKey,
+			BaseURL: cfg.OneSignalBaseURL,
+		})
+		if err != nil {
+			logger.Error("Failed to initialize OneSignal provider. Check ONESIGNAL_* settings.", log.Err(err))
+			os.Exit(1)
+		}
+		logger.Info("OneSignal provider initialized successfully.")
 	}
 
-	// Declare the permanent Dead Letter Queue (failed.queue)
-	_, err = ch.QueueDeclare("failed.queue", true, false, false, false, nil)
-	if err != nil {
-		fmt.Printf("Failed to declare failed.queue: %v. Exiting.\n", err)
-		os.Exit(1)
+	// --- 3. Connect to RabbitMQ ---
+	// The connection manager declares the topology (exchanges, queues, bindings) on every connect,
+	// or only verifies it with TOPOLOGY_MODE=verify, and reconnects with backoff when the broker goes away.
+	rabbit := middleware.NewRabbitMQ(cfg)
+
+	// Pass the initialized push provider to the worker
+	// Publishes go through the connection manager's confirm channels.
+	worker := middleware.NewPushWorker(rabbit, rdb, fcmProvider, cfg)
+	if apnsProvider != nil {
+		worker.RegisterProvider(apnsProvider)
 	}
-	// Bind failed.queue to the exchange with routing key "failed"
-	ch.QueueBind("failed.queue", "failed", cfg.ExchangeName, false, nil)
-	
-	// Declare the main Push Queue (push.queue) with DLX configuration
-	// Messages rejected or expired here will go to the DLX (Dead Letter Exchange)
-	args := amqp.Table{
-		"x-dead-letter-exchange": cfg.DLXName, // This should be a separate DLX used for routing to the permanent DLQ
+	if webPushProvider != nil {
+		worker.RegisterProvider(webPushProvider)
 	}
-
-	q, err := ch.QueueDeclare(cfg.QueueName, true, false, false, false, args)
-	if err != nil {
-		fmt.Printf("Failed to declare queue %s: %v. Exiting.\n", cfg.QueueName, err)
-		os.Exit(1)
+	if oneSignalProvider != nil {
+		worker.RegisterProvider(oneSignalProvider)
 	}
 
-	// Bind the queue to the exchange with routing key "push.queue"
-	ch.QueueBind(q.Name, "push.queue", cfg.ExchangeName, false, nil)
-	
-	// Set Quality of Service (QoS)
-	// Prefetch count of 1: only one unacknowledged message per consumer.
-	err = ch.Qos(1, 0, false) 
-	if err != nil {
-		fmt.Printf("Failed to set QoS: %v. Exiting.\n", err)
-		os.Exit(1)
-	}
+	// Expose the worker's Prometheus metrics on /metrics.
+	http.Handle("/metrics", worker.Metrics.Handler())
+	go func() {
+		if err := http.ListenAndServe(cfg.MetricsAddr, nil); err != nil {
+			logger.Error("Metrics endpoint stopped.", log.Err(err))
+		}
+	}()
 
-	// --- 5. Start Consumer Worker ---
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer tag (auto-generated)
-		false,  // auto-ack (set to false for explicit control over ACK/NACK/REJECT)
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
-		fmt.Printf("Failed to register a consumer: %v. Exiting.\n", err)
-		os.Exit(1)
-	}
+	// Probes on HEALTH_ADDR: /healthz (alive), /readyz (RabbitMQ, consumer, Redis, providers)
+	// and /status (JSON with every check and the circuit breaker states).
+	health := middleware.NewHealthServer(rabbit, worker)
+	go func() {
+		if err := http.ListenAndServe(cfg.HealthAddr, health.Handler()); err != nil {
+			logger.Error("Health endpoint stopped.", log.Err(err))
+		}
+	}()
 
-	// Pass the initialized FCM client to the worker
-	worker := middleware.NewPushWorker(ch, rdb, fcmClient, cfg) 
-	
-	// Start the message processing loop in a goroutine
-	// Each message consumed is handled in its own goroutine for concurrent processing.
+	// --- 4. Start Consumer Worker ---
+	// A fixed pool of WorkerConcurrency goroutines processes deliveries concurrently.
+	// The pool is restarted on every reconnect. Stopping consumption and aborting in-flight
+	// jobs are separate steps so shutdown can drain first.
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	jobCtx, abortJobs := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.Info("Push Notification Worker is running and listening for messages...")
+		err := rabbit.Run(consumeCtx, func(drain context.Context, msgs <-chan amqp.Delivery) {
+			middleware.NewWorkerPool(worker, worker.Settings().WorkerConcurrency).Run(jobCtx, drain, msgs)
+		})
+		if err != nil {
+			// The broker does not look like we expect; restarting will not help.
+			logger.Error("Broker topology check failed. Exiting.", log.Err(err))
+			os.Exit(1)
+		}
+	}()
+
+	// --- 5. Reload Configuration ---
+	// On SIGHUP and whenever the config file changes. Concurrency, prefetch, retries, the throttle
+	// cap, breaker thresholds, disabled providers and the log level change live; changes to
+	// anything else are logged and wait for a restart.
+	reload := func() {
+		// The loader only records the new values as running once the worker has taken them. A
+		// retry schedule the worker refuses comes back as rejected, the other settings still apply.
+		rejected, err := loader.Reload(func(next middleware.Config) error {
+			running := worker.Settings()
+			kept := worker.Reconfigure(next)
+			logLevel.Set(next.LogLevel)
+			if next.WorkerConcurrency != running.WorkerConcurrency || next.PrefetchCount != running.PrefetchCount {
+				// The pool size and prefetch only change with a new consumer; in-flight jobs finish first.
+				rabbit.Reconsume(next.PrefetchCount)
+			}
+			logger.Info("Configuration reloaded.", "concurrency", next.WorkerConcurrency, "prefetch", next.PrefetchCount,
+				"max_retries", next.MaxRetries, "log_level", next.LogLevel, "disabled_providers", next.DisabledProviders)
+			return kept
+		})
+		if err != nil {
+			logger.Error("Configuration reload failed. Keeping the running configuration.", log.Err(err))
+			return
+		}
+		for _, err := range rejected {
+			logger.Warn("Setting not reloaded.", log.Err(err))
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("SIGHUP received. Reloading configuration.")
+			reload()
+		}
+	}()
 	go func() {
-		fmt.Println("Push Notification Worker is running and listening for messages...")
-		for d := range msgs {
-			go worker.ProcessMessage(d)
+		if err := loader.Watch(ctx, reload); err != nil {
+			logger.Warn("Not watching the config file. Send SIGHUP to reload.", log.Err(err))
 		}
 	}()
 
@@ -139,8 +238,26 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	fmt.Println("Shutting down worker gracefully...")
-	ch.Close()
-	time.Sleep(2 * time.Second) 
-	fmt.Println("Push Service stopped.")
-}
\ No newline at end of file
+	// Stop taking deliveries, then give in-flight jobs until the deadline to finish and ack.
+	logger.Info("Shutting down worker gracefully, waiting for in-flight jobs...", "timeout", cfg.ShutdownTimeout)
+	stopConsuming()
+	select {
+	case <-done:
+		logger.Info("Push Service stopped.")
+	case <-time.After(cfg.ShutdownTimeout):
+		// Aborted jobs nack with requeue and release their leases, so another worker can pick them
+		// up at once instead of waiting for the lease to expire. Give them a moment to do that.
+		logger.Error("Drain timed out with jobs still in flight. Aborting them.", "timeout", cfg.ShutdownTimeout)
+		abortJobs()
+		select {
+		case <-done:
+		case <-time.After(abortGrace):
+			// Still unacked; they are redelivered once the connection closes.
+			logger.Error("Aborted jobs did not stop in time. Exiting.", "grace", abortGrace)
+		}
+		flushTraces()
+		os.Exit(1)
+	}
+	abortJobs()
+	flushTraces()
+}
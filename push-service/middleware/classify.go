@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+// failureAction is what ProcessMessage does with a job that could not be delivered.
+type failureAction string
+
+const (
+	actionRetry      failureAction = "retry"       // Re-queue with RetryCount+1
+	actionDeadLetter failureAction = "dead-letter" // Reject straight to failed.queue
+	actionDrop       failureAction = "drop"        // Ack and forget; nothing useful can be done
+)
+
+// actionFor maps a classified error to the action ProcessMessage should take.
+func actionFor(err error) failureAction {
+	if errors.Is(err, models.ErrNothingToDeliver) {
+		return actionDrop
+	}
+	switch models.ClassOf(err) {
+	case models.ErrorClassPermanent:
+		return actionDeadLetter
+	default:
+		return actionRetry
+	}
+}
+
+// classifyStatus maps an HTTP status from the User or Template Service to an ErrorClass.
+func classifyStatus(status int) models.ErrorClass {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return models.ErrorClassThrottled
+	case status == http.StatusRequestTimeout, status >= 500:
+		return models.ErrorClassTransient
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		// Our credentials are wrong or being rotated; the job itself is fine.
+		return models.ErrorClassTransient
+	case status >= 400:
+		// 404 for a missing user/template, 400/422 for a malformed request.
+		return models.ErrorClassPermanent
+	default:
+		// Unexpected 1xx/2xx/3xx: retry rather than lose the job.
+		return models.ErrorClassTransient
+	}
+}
+
+// statusError builds the classified error for a non-200 response from a downstream service,
+// carrying the Retry-After hint when the service sent one.
+func statusError(service string, resp *http.Response) error {
+	err := fmt.Errorf("%s returned status %d", service, resp.StatusCode)
+	switch classifyStatus(resp.StatusCode) {
+	case models.ErrorClassThrottled:
+		return models.Throttled(err, models.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	case models.ErrorClassPermanent:
+		return models.Permanent(err)
+	default:
+		return models.Transient(err)
+	}
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   models.ErrorClass
+	}{
+		{http.StatusBadRequest, models.ErrorClassPermanent},
+		{http.StatusNotFound, models.ErrorClassPermanent},
+		{http.StatusGone, models.ErrorClassPermanent},
+		{http.StatusUnprocessableEntity, models.ErrorClassPermanent},
+		{http.StatusUnauthorized, models.ErrorClassTransient},
+		{http.StatusForbidden, models.ErrorClassTransient},
+		{http.StatusRequestTimeout, models.ErrorClassTransient},
+		{http.StatusTooManyRequests, models.ErrorClassThrottled},
+		{http.StatusInternalServerError, models.ErrorClassTransient},
+		{http.StatusBadGateway, models.ErrorClassTransient},
+		{http.StatusServiceUnavailable, models.ErrorClassTransient},
+		{http.StatusNoContent, models.ErrorClassTransient},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			if got := classifyStatus(tt.status); got != tt.want {
+				t.Errorf("classifyStatus(%d) = %s, want %s", tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActionFor(t *testing.T) {
+	base := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		want failureAction
+	}{
+		{"unclassified", base, actionRetry},
+		{"transient", models.Transient(base), actionRetry},
+		{"throttled", models.Throttled(base, time.Second), actionRetry},
+		{"permanent", models.Permanent(base), actionDeadLetter},
+		{"wrapped permanent", fmt.Errorf("user lookup failed: %w", models.Permanent(base)), actionDeadLetter},
+		{"nothing to deliver", models.Permanent(fmt.Errorf("no devices: %w", models.ErrNothingToDeliver)), actionDrop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := actionFor(tt.err); got != tt.want {
+				t.Errorf("actionFor(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchUserDataClassifiesFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		retryAfter string
+		wantClass  models.ErrorClass
+		wantAction failureAction
+		wantDelay  time.Duration
+	}{
+		{"missing user", http.StatusNotFound, `{"success":false}`, "", models.ErrorClassPermanent, actionDeadLetter, 0},
+		{"service down", http.StatusServiceUnavailable, "", "", models.ErrorClassTransient, actionRetry, 0},
+		{"rate limited", http.StatusTooManyRequests, "", "7", models.ErrorClassThrottled, actionRetry, 7 * time.Second},
+		{"malformed json", http.StatusOK, `{"success":`, "", models.ErrorClassPermanent, actionDeadLetter, 0},
+		{"unsuccessful response", http.StatusOK, `{"success":false,"message":"nope"}`, "", models.ErrorClassPermanent, actionDeadLetter, 0},
+		{"payload mismatch", http.StatusOK, `{"success":true,"data":{"devices":"not-a-list"}}`, "", models.ErrorClassPermanent, actionDeadLetter, 0},
+		{"no devices", http.StatusOK, `{"success":true,"data":{"is_active":true,"devices":[]}}`, "", models.ErrorClassPermanent, actionDrop, 0},
+		{"inactive user", http.StatusOK, `{"success":true,"data":{"is_active":false,"devices":[{"token":"tok-1","platform":"android"}]}}`, "", models.ErrorClassPermanent, actionDrop, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			w := &PushWorker{HTTPClient: srv.Client(), UserServiceURL: srv.URL}
+			_, err := w.fetchUserData(context.Background(), "u-1")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := models.ClassOf(err); got != tt.wantClass {
+				t.Errorf("class = %s, want %s (%v)", got, tt.wantClass, err)
+			}
+			if got := actionFor(err); got != tt.wantAction {
+				t.Errorf("action = %s, want %s", got, tt.wantAction)
+			}
+			if got := models.RetryAfterOf(err); got != tt.wantDelay {
+				t.Errorf("retry after = %s, want %s", got, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestFetchUserDataNetworkErrorIsTransient(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close() // Nothing listens here any more.
+
+	w := &PushWorker{HTTPClient: &http.Client{Timeout: time.Second}, UserServiceURL: url}
+	_, err := w.fetchUserData(context.Background(), "u-1")
+	if got := models.ClassOf(err); got != models.ErrorClassTransient {
+		t.Errorf("class = %s, want transient (%v)", got, err)
+	}
+}
+
+func TestDeliveryOutcomeErr(t *testing.T) {
+	tests := []struct {
+		name       string
+		outcome    deliveryOutcome
+		want       models.ErrorClass
+		action     failureAction
+		retryAfter time.Duration
+	}{
+		{
+			name: "one throttled device",
+			outcome: deliveryOutcome{Delivered: 1, Transient: 1, Throttled: 1, Results: []models.DeviceResult{
+				{Token: "a"}, {Token: "b", Class: models.ErrorClassThrottled, Error: "429"},
+			}},
+			want: models.ErrorClassThrottled, action: actionRetry,
+		},
+		{
+			name: "quota exceeded with a retry-after",
+			outcome: deliveryOutcome{Transient: 1, Throttled: 1, RetryAfter: time.Minute, Results: []models.DeviceResult{
+				{Token: "a", Provider: "fcm", Class: models.ErrorClassThrottled, Error: "quota exceeded", RetryAfter: time.Minute},
+			}},
+			want: models.ErrorClassThrottled, action: actionRetry, retryAfter: time.Minute,
+		},
+		{
+			name: "unavailable with a retry-after",
+			outcome: deliveryOutcome{Transient: 1, RetryAfter: 30 * time.Second, Results: []models.DeviceResult{
+				{Token: "a", Provider: "fcm", Class: models.ErrorClassTransient, Error: "unavailable", RetryAfter: 30 * time.Second},
+			}},
+			want: models.ErrorClassTransient, action: actionRetry, retryAfter: 30 * time.Second,
+		},
+		{
+			name: "bad payload on every device",
+			outcome: deliveryOutcome{Permanent: 1, Results: []models.DeviceResult{
+				{Token: "a", Class: models.ErrorClassPermanent, Error: "PayloadTooLarge"},
+			}},
+			want: models.ErrorClassPermanent, action: actionDeadLetter,
+		},
+		{
+			name: "only dead tokens",
+			outcome: deliveryOutcome{Permanent: 2, Results: []models.DeviceResult{
+				{Token: "a", Class: models.ErrorClassPermanent, Error: "Unregistered", TokenInvalid: true},
+				{Token: "b", Class: models.ErrorClassPermanent, Error: errPreviouslyInvalidated},
+			}},
+			want: models.ErrorClassPermanent, action: actionDrop,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.outcome.Err()
+			if got := models.ClassOf(err); got != tt.want {
+				t.Errorf("class = %s, want %s", got, tt.want)
+			}
+			if got := actionFor(err); got != tt.action {
+				t.Errorf("action = %s, want %s", got, tt.action)
+			}
+			if got := models.RetryAfterOf(err); got != tt.retryAfter {
+				t.Errorf("retry after = %s, want %s", got, tt.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// Failure metadata headers. The worker sets them on retry copies and on the copy it publishes to
+// the DLQ, so DLQ tooling and alerting can group failures by cause. Timestamps are RFC 3339 (UTC).
+const (
+	HeaderFailureReason   = "x-failure-reason"   // Where the job failed, one of the Failure* constants
+	HeaderFailureClass    = "x-failure-class"    // models.ErrorClass of the last error
+	HeaderFailureProvider = "x-failure-provider" // Provider whose devices failed, when the last error came from delivery
+	HeaderLastError       = "x-last-error"
+	HeaderAttempts        = "x-attempts" // Processing attempts so far
+	HeaderFirstSeen       = "x-first-seen"
+	HeaderLastAttempt     = "x-last-attempt"
+	HeaderWorkerID        = "x-worker-id" // Config.InstanceID of the worker that made the last attempt
+)
+
+// Values of HeaderFailureReason.
+const (
+	FailureInvalidPayload = "invalid_payload" // Body is not a valid job
+	FailureMaxRetries     = "max_retries"     // Out of retries; class and last error are from the last attempt
+	FailureUserLookup     = "user_lookup"
+	FailureTemplateLookup = "template_lookup"
+	FailureRender         = "render"
+	FailureDelivery       = "delivery"      // Provider error; the last error names the provider per device
+	FailureRetryPublish   = "retry_publish" // The retry copy could not be published
+)
+
+// failureHeaders describes the latest failed attempt. When err is nil, the class and last error of
+// the previous attempt are kept, as for jobs that ran out of retries.
+func (w *PushWorker) failureHeaders(d amqp.Delivery, attempts int, reason string, err error) amqp.Table {
+	now := time.Now().UTC().Format(time.RFC3339)
+	firstSeen, _ := d.Headers[HeaderFirstSeen].(string)
+	if firstSeen == "" {
+		firstSeen = now
+	}
+	headers := amqp.Table{
+		HeaderFailureReason:   reason,
+		HeaderFailureClass:    d.Headers[HeaderFailureClass],
+		HeaderFailureProvider: d.Headers[HeaderFailureProvider],
+		HeaderLastError:       d.Headers[HeaderLastError],
+		HeaderAttempts:        int64(attempts),
+		HeaderFirstSeen:       firstSeen,
+		HeaderLastAttempt:     now,
+		HeaderWorkerID:        w.Config.InstanceID,
+	}
+	if err != nil {
+		headers[HeaderFailureClass] = string(models.ClassOf(err))
+		headers[HeaderLastError] = err.Error()
+		headers[HeaderFailureProvider] = nil
+		if provider := providerOf(err); provider != providerNone {
+			headers[HeaderFailureProvider] = provider
+		}
+	}
+	for k, v := range headers {
+		if v == nil {
+			delete(headers, k)
+		}
+	}
+	return headers
+}
+
+// deadLetter publishes the delivery to the DLQ with failure metadata and acks the original. job is
+// nil when the body could not be parsed. If the DLQ publish fails, the delivery is rejected instead,
+// so RabbitMQ still dead-letters it, only without the metadata.
+func (w *PushWorker) deadLetter(ctx context.Context, d amqp.Delivery, job *models.PushNotificationJob, reason string, err error) {
+	attempts := 1
+	if job != nil {
+		attempts = job.RetryCount + 1
+		if reason == FailureMaxRetries {
+			attempts = job.RetryCount // Not attempted again this time
+		}
+	}
+
+	headers := w.failureHeaders(d, attempts, reason, err)
+	class, _ := headers[HeaderFailureClass].(string)
+	provider, _ := headers[HeaderFailureProvider].(string)
+	if provider == "" {
+		provider = providerNone
+	}
+	w.Metrics.jobFailed(reason, class, provider, true)
+
+	// The DLQ gets the job as it was received; the DLX routes it to failed.queue.
+	publishErr := w.RabbitMQChannel.Publish(w.Config.DLXName, w.Config.QueueName, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: correlationID(job),
+		Headers:       injectTrace(ctx, headers),
+		Body:          d.Body,
+	})
+	if publishErr != nil {
+		logger := w.Logger
+		if job != nil {
+			logger = w.log(*job)
+		}
+		logger.Warn("Failed to publish to the DLQ. Rejecting without failure metadata.", log.Err(publishErr))
+		d.Reject(false)
+		return
+	}
+	d.Ack(false)
+}
+
+func correlationID(job *models.PushNotificationJob) string {
+	if job == nil {
+		return ""
+	}
+	return job.CorrelationID
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+func TestDeadLetterCarriesFailureHistoryFromRetries(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-1", CorrelationID: "c-1", UserID: "u-1", TemplateID: "welcome"})
+	var retry publishedMessage
+	for _, m := range tw.pub.published {
+		if m.Key == "push.queue.retry.5s" {
+			retry = m
+		}
+	}
+	if retry.Msg.Headers[HeaderAttempts] != int64(1) || retry.Msg.Headers[HeaderFailureReason] != FailureDelivery {
+		t.Fatalf("retry copy headers = %v", retry.Msg.Headers)
+	}
+	firstSeen := retry.Msg.Headers[HeaderFirstSeen]
+
+	// The last retry comes back out of retries; its DLQ copy keeps the history of the retry copy.
+	var job models.PushNotificationJob
+	json.Unmarshal(retry.Msg.Body, &job)
+	job.RetryCount = tw.Config.MaxRetries
+	body, _ := json.Marshal(job)
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Headers: retry.Msg.Headers, Body: body})
+
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+	dead := tw.pub.deadLettered()
+	if len(dead) != 1 {
+		t.Fatalf("%d DLQ copies published, want 1", len(dead))
+	}
+	h := dead[0].Headers
+	want := amqp.Table{
+		HeaderFailureReason: FailureMaxRetries,
+		HeaderFailureClass:  string(models.ErrorClassTransient),
+		HeaderAttempts:      int64(5),
+		HeaderFirstSeen:     firstSeen,
+		HeaderWorkerID:      "worker-test",
+	}
+	for k, v := range want {
+		if h[k] != v {
+			t.Errorf("%s = %v, want %v", k, h[k], v)
+		}
+	}
+	if msg, _ := h[HeaderLastError].(string); !strings.Contains(msg, "fcm unavailable") {
+		t.Errorf("%s = %q, want the provider error", HeaderLastError, msg)
+	}
+	if h[HeaderLastAttempt] == nil {
+		t.Errorf("%s not set", HeaderLastAttempt)
+	}
+	if dead[0].CorrelationId != "c-1" || string(dead[0].Body) != string(body) {
+		t.Errorf("DLQ copy = %+v, want the job as received", dead[0])
+	}
+}
+
+func TestDeadLetterInvalidPayload(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices())
+
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Body: []byte("not json")})
+
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+	dead := tw.pub.deadLettered()
+	if len(dead) != 1 {
+		t.Fatalf("%d DLQ copies published, want 1", len(dead))
+	}
+	h := dead[0].Headers
+	if h[HeaderFailureReason] != FailureInvalidPayload || h[HeaderFailureClass] != string(models.ErrorClassPermanent) || h[HeaderAttempts] != int64(1) {
+		t.Errorf("DLQ headers = %v", h)
+	}
+}
+
+func TestDeadLetterFallsBackToRejectWhenPublishFails(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices())
+	tw.pub.err = errors.New("channel closed")
+
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Body: []byte("not json")})
+
+	if ack.get() != "reject" {
+		t.Fatalf("delivery outcome = %q, want reject so RabbitMQ dead-letters it", ack.get())
+	}
+}
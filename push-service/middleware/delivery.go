@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errPreviouslyInvalidated is the result error for devices skipped because of the token registry.
+const errPreviouslyInvalidated = "device token was previously invalidated"
+
+// errProviderDisabled is the result error for devices whose provider is in DisabledProviders.
+const errProviderDisabled = "provider is disabled"
+
+// deliveryOutcome summarizes the per-device results of one job.
+type deliveryOutcome struct {
+	Results   []models.DeviceResult
+	Delivered int // Sent now or by an earlier attempt
+	Permanent int
+	Transient int // Transient and throttled failures; these devices are resent on retry
+	Throttled int // Subset of Transient rejected by provider rate limits
+
+	// RetryAfter is the longest back-off any provider asked for, and BackoffProvider the provider that asked.
+	RetryAfter      time.Duration
+	BackoffProvider string
+}
+
+// deliverToDevices fans the rendered notification out to every device of the user.
+// Devices are grouped by provider and each group is sent with one SendBatch call through that
+// provider's circuit breaker. Devices that already received this job on an earlier attempt are skipped,
+// so a retry only resends to the devices that failed.
+func (w *PushWorker) deliverToDevices(ctx context.Context, job models.PushNotificationJob, user models.UserData, content models.PushMessage) deliveryOutcome {
+	devices := user.DeviceList()
+	out := deliveryOutcome{Results: make([]models.DeviceResult, len(devices))}
+
+	type pending struct {
+		index int
+		msg   models.PushMessage
+	}
+	groups := map[string][]pending{}
+	var order []string
+	disabled := w.Settings().DisabledProviders
+
+	for i, device := range devices {
+		result := &out.Results[i]
+		result.Token = device.Token
+
+		provider, err := w.providerFor(job, user, device)
+		if err != nil {
+			result.Class, result.Error = models.ErrorClassPermanent, err.Error()
+			continue
+		}
+		result.Provider = provider.Name()
+
+		if slices.Contains(disabled, provider.Name()) {
+			// Switched off by an operator; the device is retried until it is switched back on.
+			result.Class, result.Error = models.ErrorClassTransient, errProviderDisabled
+			continue
+		}
+
+		if invalid, err := w.TokenRegistry.IsInvalid(ctx, device.Token); err != nil {
+			w.log(job).Warn("Token registry lookup failed. Sending anyway.", "device", maskToken(device.Token), log.Err(err))
+		} else if invalid {
+			// Already reported dead; don't spend quota on it while the User Service catches up.
+			result.Class, result.Error = models.ErrorClassPermanent, errPreviouslyInvalidated
+			continue
+		}
+
+		if w.isDeliveredToDevice(ctx, job.RequestID, device.Token) {
+			result.Skipped = true
+			continue
+		}
+
+		msg := content
+		msg.Token = device.Token
+		msg.AppID = device.AppID
+		msg.Subscription = device.Subscription
+
+		if _, ok := groups[provider.Name()]; !ok {
+			order = append(order, provider.Name())
+		}
+		groups[provider.Name()] = append(groups[provider.Name()], pending{index: i, msg: msg})
+	}
+
+	for _, name := range order {
+		provider, breaker, batch := w.Providers[name], w.Breakers[name], groups[name]
+
+		msgs := make([]models.PushMessage, len(batch))
+		for i, p := range batch {
+			msgs[i] = p.msg
+		}
+
+		sendCtx, span := w.Tracer.Start(ctx, "push.provider.send", trace.WithAttributes(
+			attribute.String("push.provider", name),
+			attribute.Int("push.devices", len(msgs)),
+		))
+		var sendResults []models.SendResult
+		_, err := breaker.Execute(func() (interface{}, error) {
+			start := time.Now()
+			res, err := provider.SendBatch(sendCtx, msgs)
+			since(w.Metrics.providerSendSeconds.WithLabelValues(name), start)
+			sendResults = res
+			if err != nil {
+				return nil, err
+			}
+			// Report the batch as failed to the breaker only when no device was reachable
+			// for provider-side reasons; dead tokens are the device's fault, not the provider's.
+			var lastErr error
+			for _, r := range res {
+				if r.Error == nil || provider.ClassifyError(r.Error) == models.ErrorClassPermanent {
+					return nil, nil
+				}
+				lastErr = r.Error
+			}
+			return nil, lastErr
+		})
+		endSpan(span, err)
+
+		for i, p := range batch {
+			result := &out.Results[p.index]
+			var sendErr error
+			switch {
+			case i < len(sendResults):
+				result.MessageID, sendErr = sendResults[i].MessageID, sendResults[i].Error
+			case err != nil:
+				// Breaker open or the whole batch failed before any result was produced.
+				sendErr = fmt.Errorf("%s delivery failed (CB state: %s): %w", name, breaker.State().String(), err)
+			}
+
+			if sendErr != nil {
+				result.Class, result.Error = provider.ClassifyError(sendErr), sendErr.Error()
+				result.RetryAfter = provider.RetryAfter(sendErr)
+				if provider.IsTokenInvalid(sendErr) {
+					// A dead token is never worth retrying, whatever the generic class says.
+					result.Class, result.TokenInvalid = models.ErrorClassPermanent, true
+				}
+				w.Metrics.providerSends.WithLabelValues(name, string(result.Class)).Inc()
+				continue
+			}
+			w.Metrics.providerSends.WithLabelValues(name, "success").Inc()
+			w.markDeviceDelivered(ctx, job.RequestID, p.msg.Token, result.MessageID)
+		}
+	}
+
+	for _, r := range out.Results {
+		if r.Error != "" && r.Class != models.ErrorClassPermanent && r.RetryAfter > out.RetryAfter {
+			out.RetryAfter, out.BackoffProvider = r.RetryAfter, r.Provider
+		}
+		switch {
+		case r.Error == "":
+			out.Delivered++
+		case r.Class == models.ErrorClassPermanent:
+			out.Permanent++
+		case r.Class == models.ErrorClassThrottled:
+			out.Transient++
+			out.Throttled++
+		default:
+			out.Transient++
+		}
+	}
+	return out
+}
+
+// pruneInvalidTokens marks every token a provider reported as dead in the token registry and
+// publishes a push.token.invalidated event so the User Service can delete it. A token whose event
+// could not be published is taken out of the registry again, so a later attempt reports it.
+func (w *PushWorker) pruneInvalidTokens(ctx context.Context, job models.PushNotificationJob, user models.UserData, outcome deliveryOutcome) {
+	devices := user.DeviceList()
+	logger := w.log(job)
+	for i, r := range outcome.Results {
+		if !r.TokenInvalid {
+			continue
+		}
+		event := models.TokenInvalidatedEvent{
+			UserID:    job.UserID,
+			Token:     r.Token,
+			Platform:  devices[i].Platform,
+			Provider:  r.Provider,
+			Reason:    r.Error,
+			RequestID: job.RequestID,
+			Timestamp: time.Now().UTC(),
+		}
+
+		fresh, err := w.TokenRegistry.MarkInvalid(ctx, event)
+		if err != nil {
+			logger.Warn("Failed to record invalid token.", "device", maskToken(r.Token), log.Err(err))
+		}
+		if !fresh && err == nil {
+			continue // Another worker already reported this token.
+		}
+
+		body, _ := json.Marshal(event)
+		publishErr := w.RabbitMQChannel.Publish(w.Config.ExchangeName, w.Config.TokenInvalidatedRoutingKey, false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Headers:      injectTrace(ctx, nil),
+			Body:         body,
+		})
+		if publishErr != nil {
+			logger.Warn("Failed to publish token invalidation.", "device", maskToken(r.Token), log.Err(publishErr))
+			// Drop our claim, or the next attempt would take the token as already reported.
+			if fresh {
+				if err := w.TokenRegistry.Forget(context.WithoutCancel(ctx), r.Token); err != nil {
+					logger.Warn("Failed to remove unreported token from the registry.", "device", maskToken(r.Token), log.Err(err))
+				}
+			}
+			continue
+		}
+		logger.Info("Device token invalidated and reported to User Service.", "device", maskToken(r.Token), "provider", r.Provider)
+	}
+}
+
+// Err describes the failed devices as a classified error, or returns nil when every device was reached.
+// Any throttled or transient device makes the whole job retryable, no sooner than the longest
+// back-off a provider asked for; when only dead tokens are left there is nothing to deliver and the job is dropped.
+func (o deliveryOutcome) Err() error {
+	var failures []string
+	allTokensInvalid := true
+	for _, r := range o.Results {
+		if r.Error != "" {
+			failures = append(failures, fmt.Sprintf("%s/%s (%s): %s", r.Provider, maskToken(r.Token), r.Class, r.Error))
+			allTokensInvalid = allTokensInvalid && (r.TokenInvalid || r.Error == errPreviouslyInvalidated)
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d of %d devices failed: %s", len(failures), len(o.Results), strings.Join(failures, "; "))
+	switch {
+	case o.Throttled > 0:
+		err = models.Throttled(err, o.RetryAfter)
+	case o.Transient > 0:
+		err = &models.ClassifiedError{Class: models.ErrorClassTransient, RetryAfter: o.RetryAfter, Err: err}
+	case o.Delivered == 0 && allTokensInvalid:
+		err = models.Permanent(fmt.Errorf("%w: %w", models.ErrNothingToDeliver, err))
+	default:
+		err = models.Permanent(err)
+	}
+	return &providerError{provider: o.failedProvider(), err: err}
+}
+
+// failedProvider names the provider whose devices failed, or providerMultiple when several did.
+func (o deliveryOutcome) failedProvider() string {
+	provider := ""
+	for _, r := range o.Results {
+		if r.Error == "" {
+			continue
+		}
+		if provider != "" && provider != r.Provider {
+			return providerMultiple
+		}
+		provider = r.Provider
+	}
+	return provider
+}
+
+// Values of the provider label of job failures that are not down to a single provider.
+const (
+	providerNone     = "none"     // Failed before delivery: invalid payload, lookups or rendering
+	providerMultiple = "multiple" // Devices of more than one provider failed
+)
+
+// providerError records which provider a delivery failure came from, for the job metrics and the
+// failure headers.
+type providerError struct {
+	provider string
+	err      error
+}
+
+func (e *providerError) Error() string { return e.err.Error() }
+func (e *providerError) Unwrap() error { return e.err }
+
+// providerOf returns the provider a job failure came from, or providerNone.
+func providerOf(err error) string {
+	var pe *providerError
+	if errors.As(err, &pe) && pe.provider != "" {
+		return pe.provider
+	}
+	return providerNone
+}
+
+// maskToken keeps device tokens out of the logs while still telling them apart.
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return token
+	}
+	return "..." + token[len(token)-8:]
+}
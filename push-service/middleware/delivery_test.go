@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// flakyProvider fails the given token transiently once, and records every token it is asked to send to.
+func flakyProvider(failOnce string) (*fakeProvider, *[]string) {
+	var sent []string
+	failed := false
+	return &fakeProvider{name: "fcm", send: func(msg models.PushMessage) (string, error) {
+		sent = append(sent, msg.Token)
+		if msg.Token == failOnce && !failed {
+			failed = true
+			return "", models.Transient(errors.New("fcm unavailable"))
+		}
+		return "msg-" + msg.Token, nil
+	}}, &sent
+}
+
+func TestRetryResendsOnlyToFailedDevice(t *testing.T) {
+	provider, sent := flakyProvider("tok-2")
+	tw := newTestWorker(t, provider, userWithDevices("tok-1", "tok-2", "tok-3"))
+
+	ack := tw.process(t, models.PushNotificationJob{NotificationID: "n-1", RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("first attempt outcome = %q, want ack after re-publishing", ack.get())
+	}
+	if got := strings.Join(*sent, ","); got != "tok-1,tok-2,tok-3" {
+		t.Fatalf("first attempt sent to %s, want every device", got)
+	}
+	retries := tw.pub.byKey("push.queue.retry.5s")
+	if len(retries) != 1 {
+		t.Fatalf("%d retries published, want 1", len(retries))
+	}
+
+	// The retry queue hands the job back once its delay has passed.
+	*sent = nil
+	ack = &fakeAcknowledger{}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Body: retries[0]})
+	if ack.get() != "ack" {
+		t.Fatalf("retry outcome = %q, want ack", ack.get())
+	}
+	if got := strings.Join(*sent, ","); got != "tok-2" {
+		t.Errorf("retry sent to %s, want only the device that failed", got)
+	}
+
+	events := tw.pub.statuses(t)
+	if got := statusList(events); got != "pending,pending,pending,delivered" {
+		t.Fatalf("statuses = %s, want pending,pending,pending,delivered", got)
+	}
+	if ids := events[3].MessageIDs; strings.Join(ids, ",") != "msg-tok-2" {
+		t.Errorf("delivered message IDs = %v, want only the device reached on the retry", ids)
+	}
+}
+
+func TestDeliverToDevicesSkipsDevicesReachedEarlier(t *testing.T) {
+	provider, sent := flakyProvider("tok-2")
+	tw := newTestWorker(t, provider, userWithDevices())
+
+	job := models.PushNotificationJob{RequestID: "r-1", UserID: "u-1"}
+	user := models.UserData{IsActive: true, Devices: []models.Device{
+		{Token: "tok-1", Platform: models.PlatformAndroid},
+		{Token: "tok-2", Platform: models.PlatformAndroid},
+		{Token: "tok-3", Platform: models.PlatformAndroid},
+	}}
+	content := models.PushMessage{Title: "Hi", Body: "Welcome"}
+
+	first := tw.deliverToDevices(context.Background(), job, user, content)
+	if first.Delivered != 2 || first.Transient != 1 || first.Permanent != 0 {
+		t.Fatalf("first attempt: delivered %d, transient %d, permanent %d; want 2, 1, 0", first.Delivered, first.Transient, first.Permanent)
+	}
+	if r := first.Results[1]; r.Class != models.ErrorClassTransient || r.Skipped {
+		t.Errorf("tok-2 on the first attempt = %+v, want a transient failure", r)
+	}
+
+	*sent = nil
+	second := tw.deliverToDevices(context.Background(), job, user, content)
+	if got := strings.Join(*sent, ","); got != "tok-2" {
+		t.Errorf("second attempt sent to %s, want tok-2", got)
+	}
+	if second.Delivered != 3 || second.Transient != 0 {
+		t.Errorf("second attempt: delivered %d, transient %d; want 3, 0", second.Delivered, second.Transient)
+	}
+	for i, want := range []bool{true, false, true} {
+		if r := second.Results[i]; r.Skipped != want || r.Error != "" {
+			t.Errorf("%s: skipped = %t, error %q; want skipped = %t", r.Token, r.Skipped, r.Error, want)
+		}
+	}
+	if r := second.Results[1]; r.MessageID != "msg-tok-2" {
+		t.Errorf("tok-2 message ID = %q, want msg-tok-2", r.MessageID)
+	}
+
+	// A different job goes to every device again.
+	*sent = nil
+	tw.deliverToDevices(context.Background(), models.PushNotificationJob{RequestID: "r-2", UserID: "u-1"}, user, content)
+	if got := strings.Join(*sent, ","); got != "tok-1,tok-2,tok-3" {
+		t.Errorf("another job sent to %s, want every device", got)
+	}
+}
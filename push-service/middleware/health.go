@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// healthCheckTimeout bounds each dependency check, so a hung Redis cannot hang the probe.
+const healthCheckTimeout = 2 * time.Second
+
+// Check is the state of one dependency.
+type Check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Status is the /status document.
+type Status struct {
+	Status     string            `json:"status"` // "ok" or "unavailable"
+	InstanceID string            `json:"instance_id"`
+	Uptime     string            `json:"uptime"`
+	Checks     map[string]Check  `json:"checks"`
+	Breakers   map[string]string `json:"breakers"` // Provider circuit breaker states: closed, half-open, open
+}
+
+// HealthServer answers the probes for the worker:
+//
+//	/healthz  the process is alive (always 200 while it can serve HTTP)
+//	/readyz   connected to RabbitMQ, consuming, Redis reachable and providers initialised (200 or 503)
+//	/status   every check and the circuit breaker states as JSON
+type HealthServer struct {
+	rabbit  *RabbitMQ
+	worker  *PushWorker
+	started time.Time
+}
+
+// NewHealthServer creates the probe handlers for the worker and its RabbitMQ connection.
+func NewHealthServer(rabbit *RabbitMQ, worker *PushWorker) *HealthServer {
+	return &HealthServer{rabbit: rabbit, worker: worker, started: time.Now()}
+}
+
+// Handler routes /healthz, /readyz and /status.
+func (h *HealthServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/status", h.status)
+	return mux
+}
+
+func (h *HealthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := h.checks(r.Context())
+	var failed []string
+	for _, name := range slices.Sorted(maps.Keys(checks)) {
+		if c := checks[name]; !c.OK {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, c.Detail))
+		}
+	}
+	if len(failed) > 0 {
+		http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *HealthServer) status(w http.ResponseWriter, r *http.Request) {
+	s := Status{
+		Status:     "ok",
+		InstanceID: h.worker.Config.InstanceID,
+		Uptime:     time.Since(h.started).Round(time.Second).String(),
+		Checks:     h.checks(r.Context()),
+		Breakers:   map[string]string{},
+	}
+	for _, c := range s.Checks {
+		if !c.OK {
+			s.Status = "unavailable"
+		}
+	}
+	for name, b := range h.worker.Breakers {
+		s.Breakers[name] = b.State().String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if s.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+// checks runs the readiness checks.
+func (h *HealthServer) checks(ctx context.Context) map[string]Check {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	checks := map[string]Check{}
+
+	if connected, err := h.rabbit.Connected(); connected {
+		checks["rabbitmq"] = Check{OK: true}
+	} else {
+		checks["rabbitmq"] = Check{Detail: describe("not connected", err)}
+	}
+	if h.rabbit.Ready() {
+		checks["consumer"] = Check{OK: true, Detail: "consuming from " + h.worker.Config.QueueName}
+	} else {
+		checks["consumer"] = Check{Detail: "not consuming from " + h.worker.Config.QueueName}
+	}
+
+	if err := h.worker.RedisClient.Ping(ctx).Err(); err != nil {
+		checks["redis"] = Check{Detail: describe("unreachable", err)}
+	} else {
+		checks["redis"] = Check{OK: true}
+	}
+
+	if h.worker.Provider == nil || len(h.worker.Providers) == 0 {
+		checks["providers"] = Check{Detail: "no push provider initialised"}
+	} else {
+		checks["providers"] = Check{OK: true, Detail: strings.Join(slices.Sorted(maps.Keys(h.worker.Providers)), ", ")}
+	}
+	return checks
+}
+
+func describe(state string, err error) string {
+	if err == nil {
+		return state
+	}
+	return fmt.Sprintf("%s: %v", state, err)
+}
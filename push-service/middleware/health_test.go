@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+)
+
+func probe(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func newTestHealthServer(t *testing.T) (*HealthServer, *RabbitMQ, *testWorker) {
+	t.Helper()
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+	rabbit := NewRabbitMQ(tw.Config)
+	return NewHealthServer(rabbit, tw.PushWorker), rabbit, tw
+}
+
+func TestReadyWhenConnectedAndConsuming(t *testing.T) {
+	health, rabbit, _ := newTestHealthServer(t)
+	rabbit.setPublisher(&ConfirmPublisher{})
+	rabbit.ready.Store(true)
+	h := health.Handler()
+
+	if rec := probe(t, h, "/readyz"); rec.Code != http.StatusOK {
+		t.Fatalf("/readyz = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	rec := probe(t, h, "/status")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/status = %d, want 200", rec.Code)
+	}
+	var s Status
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != "ok" || len(s.Checks) != 4 || s.Breakers["fcm"] != "closed" || s.InstanceID != "worker-test" {
+		t.Errorf("status = %+v", s)
+	}
+	if s.Checks["providers"].Detail != "fcm" {
+		t.Errorf("providers check = %+v", s.Checks["providers"])
+	}
+}
+
+func TestNotReadyReportsFailedDependencies(t *testing.T) {
+	health, rabbit, tw := newTestHealthServer(t)
+	rabbit.setLastErr(errors.New("connection refused"))
+	tw.redis.Close()
+	h := health.Handler()
+
+	// Alive even with every dependency down.
+	if rec := probe(t, h, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", rec.Code)
+	}
+
+	rec := probe(t, h, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz = %d, want 503", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"rabbitmq: not connected: connection refused", "consumer: not consuming", "redis: unreachable"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/readyz body %q is missing %q", body, want)
+		}
+	}
+	if strings.Contains(body, "providers") {
+		t.Errorf("/readyz reports providers as failed: %q", body)
+	}
+
+	rec = probe(t, h, "/status")
+	var s Status
+	json.NewDecoder(rec.Body).Decode(&s)
+	if rec.Code != http.StatusServiceUnavailable || s.Status != "unavailable" || s.Checks["redis"].OK || !s.Checks["providers"].OK {
+		t.Errorf("/status = %d %+v", rec.Code, s)
+	}
+}
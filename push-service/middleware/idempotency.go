@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/go-redis/redis/v8"
+)
+
+// Job idempotency is a small state machine per request ID:
+//
+//	(none) --Acquire--> processing:<lease> --MarkProcessed--> processed:<timestamp>
+//	                           |
+//	                           +--Release / lease expiry--> (none)
+//
+// The processing lease is short and renewed while the job is in flight, so a worker that crashes
+// mid-delivery only blocks redeliveries until the lease runs out. Only a finished job leaves the
+// long-lived processed record behind.
+const (
+	processingPrefix = "processing:"
+	processedPrefix  = "processed:"
+)
+
+// LeaseState is the result of trying to claim a job.
+type LeaseState string
+
+const (
+	LeaseAcquired  LeaseState = "acquired"  // We own the job now
+	LeaseInFlight  LeaseState = "in_flight" // Another worker holds a live lease
+	LeaseProcessed LeaseState = "processed" // The job already completed
+)
+
+// Lease is one worker's claim on a job.
+type Lease struct {
+	RequestID string
+	Value     string // processing:<random id>, unique per attempt
+}
+
+// IdempotencyStore keeps track of which jobs are in flight or done, and which devices of a job
+// were already reached, so redeliveries and retries never notify a device twice.
+type IdempotencyStore interface {
+	// Acquire claims the job unless it is processed or leased by another worker.
+	Acquire(ctx context.Context, requestID string) (*Lease, LeaseState, error)
+	// Renew extends a lease; false means the lease expired and was lost.
+	Renew(ctx context.Context, l *Lease) (bool, error)
+	// Release drops a lease so a retry or DLQ replay can claim the job. Leases held by others are left alone.
+	Release(ctx context.Context, l *Lease) error
+	// MarkProcessed replaces the lease with the long-lived processed record.
+	MarkProcessed(ctx context.Context, requestID string) error
+	// DeviceDelivered reports whether an earlier attempt of the job already reached the device.
+	DeviceDelivered(ctx context.Context, requestID, token string) (bool, error)
+	// MarkDeviceDelivered records a successful delivery to one device with the provider message ID.
+	MarkDeviceDelivered(ctx context.Context, requestID, token, messageID string) error
+	// Ping reports whether the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+// What the worker does when the idempotency store cannot be reached.
+const (
+	FailOpen   = "open"   // Process the job without the duplicate check
+	FailClosed = "closed" // Park the job in the shortest retry tier until the store is back
+	FailPause  = "pause"  // Requeue the job and stop consuming until the store is back
+)
+
+// NewIdempotencyStore builds the store selected by IDEMPOTENCY_BACKEND: "redis" (default) or "memory".
+// The memory store only replaces the idempotency records; rdb is still used by the token registry
+// and the throttle.
+func NewIdempotencyStore(cfg Config, rdb *redis.Client) IdempotencyStore {
+	if cfg.IdempotencyBackend == "memory" {
+		return NewMemoryIdempotencyStore(defaultMemoryStoreSize, cfg.IdempotencyTTL, cfg.ProcessingLeaseTTL)
+	}
+	return NewRedisIdempotencyStore(rdb, cfg.IdempotencyPrefix, cfg.IdempotencyTTL, cfg.ProcessingLeaseTTL)
+}
+
+// keepLeaseAlive renews the lease every third of its TTL until the returned stop function is called.
+func (w *PushWorker) keepLeaseAlive(ctx context.Context, l *Lease) (stop func()) {
+	if l == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(w.Config.ProcessingLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewed, err := w.Idempotency.Renew(ctx, l)
+				if err == nil && !renewed {
+					w.Logger.Warn("Processing lease was lost. The job may be delivered twice.", log.RequestID, l.RequestID)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Bookkeeping below ignores cancellation of ctx: a job aborted by shutdown must still release its
+// lease, and a notification that already went out must still be recorded.
+
+// releaseLease drops our claim so a retry or a DLQ replay can pick the job up again.
+func (w *PushWorker) releaseLease(ctx context.Context, l *Lease) {
+	if l == nil {
+		return
+	}
+	if err := w.Idempotency.Release(context.WithoutCancel(ctx), l); err != nil {
+		w.Logger.Warn("Failed to release processing lease.", log.RequestID, l.RequestID, log.Err(err))
+	}
+}
+
+// markAsProcessed records the job as done.
+func (w *PushWorker) markAsProcessed(ctx context.Context, requestID string) {
+	if err := w.Idempotency.MarkProcessed(context.WithoutCancel(ctx), requestID); err != nil {
+		w.Logger.Warn("Failed to mark job as processed. A redelivery may notify again.", log.RequestID, requestID, log.Err(err))
+	}
+}
+
+// isDeliveredToDevice reports whether an earlier attempt of this job already reached the device.
+func (w *PushWorker) isDeliveredToDevice(ctx context.Context, requestID, token string) bool {
+	delivered, err := w.Idempotency.DeviceDelivered(ctx, requestID, token)
+	if err != nil {
+		w.Logger.Warn("Device idempotency lookup failed. Device may receive a duplicate.", log.RequestID, requestID, log.Err(err))
+		return false
+	}
+	return delivered
+}
+
+// markDeviceDelivered records a successful delivery to one device, storing the provider message ID.
+func (w *PushWorker) markDeviceDelivered(ctx context.Context, requestID, token, messageID string) {
+	if err := w.Idempotency.MarkDeviceDelivered(context.WithoutCancel(ctx), requestID, token, messageID); err != nil {
+		w.Logger.Warn("Failed to record delivery to device.", log.RequestID, requestID, "device", maskToken(token), log.Err(err))
+	}
+}
+
+func newLease(requestID string) *Lease {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Lease{RequestID: requestID, Value: processingPrefix + hex.EncodeToString(b)}
+}
+
+// tokenHash shortens device tokens for keys. Tokens can be long (Web Push endpoints).
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
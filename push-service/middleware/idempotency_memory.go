@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// defaultMemoryStoreSize bounds the in-memory store; the least recently used records are evicted first.
+const defaultMemoryStoreSize = 100_000
+
+// memoryRecord is a job state or device marker with its own expiry, like a Redis key with a TTL.
+type memoryRecord struct {
+	value     string
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore keeps idempotency state in a bounded LRU inside the process.
+// It is meant for local development and unit tests: state is not shared between instances
+// and is lost on restart.
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex // Makes check-then-set sequences atomic, like the Redis scripts
+	cache    *lru.Cache[string, memoryRecord]
+	ttl      time.Duration
+	leaseTTL time.Duration
+	now      func() time.Time
+}
+
+// NewMemoryIdempotencyStore creates an in-memory store holding at most size records.
+func NewMemoryIdempotencyStore(size int, ttl, leaseTTL time.Duration) *MemoryIdempotencyStore {
+	cache, err := lru.New[string, memoryRecord](size)
+	if err != nil {
+		panic(err) // Only fails for a non-positive size
+	}
+	return &MemoryIdempotencyStore{cache: cache, ttl: ttl, leaseTTL: leaseTTL, now: time.Now}
+}
+
+// get returns a live record, dropping it if it has expired.
+func (s *MemoryIdempotencyStore) get(key string) (string, bool) {
+	rec, ok := s.cache.Get(key)
+	if !ok {
+		return "", false
+	}
+	if !s.now().Before(rec.expiresAt) {
+		s.cache.Remove(key)
+		return "", false
+	}
+	return rec.value, true
+}
+
+func (s *MemoryIdempotencyStore) set(key, value string, ttl time.Duration) {
+	s.cache.Add(key, memoryRecord{value: value, expiresAt: s.now().Add(ttl)})
+}
+
+// Acquire implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Acquire(ctx context.Context, requestID string) (*Lease, LeaseState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(requestID); ok {
+		if strings.HasPrefix(v, processingPrefix) {
+			return nil, LeaseInFlight, nil
+		}
+		return nil, LeaseProcessed, nil
+	}
+	l := newLease(requestID)
+	s.set(requestID, l.Value, s.leaseTTL)
+	return l, LeaseAcquired, nil
+}
+
+// Renew implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Renew(ctx context.Context, l *Lease) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(l.RequestID); !ok || v != l.Value {
+		return false, nil
+	}
+	s.set(l.RequestID, l.Value, s.leaseTTL)
+	return true, nil
+}
+
+// Release implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, l *Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(l.RequestID); ok && v == l.Value {
+		s.cache.Remove(l.RequestID)
+	}
+	return nil
+}
+
+// MarkProcessed implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) MarkProcessed(ctx context.Context, requestID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(requestID, processedPrefix+s.now().Format(time.RFC3339), s.ttl)
+	return nil
+}
+
+// DeviceDelivered implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) DeviceDelivered(ctx context.Context, requestID, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.get(requestID + ":device:" + tokenHash(token))
+	return ok, nil
+}
+
+// MarkDeviceDelivered implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) MarkDeviceDelivered(ctx context.Context, requestID, token, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(requestID+":device:"+tokenHash(token), messageID, s.ttl)
+	return nil
+}
+
+// Ping implements IdempotencyStore; the in-memory store is always available.
+func (s *MemoryIdempotencyStore) Ping(ctx context.Context) error { return nil }
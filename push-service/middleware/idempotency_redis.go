@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// acquireScript claims a job unless it is processed or leased. Values written before leases
+// existed are plain timestamps and count as processed.
+var acquireScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 'acquired'
+end
+if string.sub(v, 1, 11) == 'processing:' then
+	return 'in_flight'
+end
+return 'processed'
+`)
+
+// renewScript and releaseScript only touch the key while it still holds our lease, so a worker
+// whose lease already expired cannot extend or delete someone else's.
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisIdempotencyStore shares idempotency state between all worker instances.
+// Keys are <prefix><request_id> for jobs and <prefix><request_id>:device:<token hash> for devices.
+type RedisIdempotencyStore struct {
+	rdb      *redis.Client
+	prefix   string
+	ttl      time.Duration // Lifetime of processed and device records
+	leaseTTL time.Duration
+}
+
+// NewRedisIdempotencyStore creates the Redis-backed store.
+func NewRedisIdempotencyStore(rdb *redis.Client, prefix string, ttl, leaseTTL time.Duration) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{rdb: rdb, prefix: prefix, ttl: ttl, leaseTTL: leaseTTL}
+}
+
+func (s *RedisIdempotencyStore) jobKey(requestID string) string {
+	return s.prefix + requestID
+}
+
+func (s *RedisIdempotencyStore) deviceKey(requestID, token string) string {
+	return s.prefix + requestID + ":device:" + tokenHash(token)
+}
+
+// Acquire implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Acquire(ctx context.Context, requestID string) (*Lease, LeaseState, error) {
+	l := newLease(requestID)
+	state, err := acquireScript.Run(ctx, s.rdb, []string{s.jobKey(requestID)}, l.Value, s.leaseTTL.Milliseconds()).Text()
+	if err != nil {
+		return nil, "", err
+	}
+	if LeaseState(state) != LeaseAcquired {
+		return nil, LeaseState(state), nil
+	}
+	return l, LeaseAcquired, nil
+}
+
+// Renew implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Renew(ctx context.Context, l *Lease) (bool, error) {
+	renewed, err := renewScript.Run(ctx, s.rdb, []string{s.jobKey(l.RequestID)}, l.Value, s.leaseTTL.Milliseconds()).Int()
+	return renewed == 1, err
+}
+
+// Release implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Release(ctx context.Context, l *Lease) error {
+	return releaseScript.Run(ctx, s.rdb, []string{s.jobKey(l.RequestID)}, l.Value).Err()
+}
+
+// MarkProcessed implements IdempotencyStore.
+func (s *RedisIdempotencyStore) MarkProcessed(ctx context.Context, requestID string) error {
+	return s.rdb.Set(ctx, s.jobKey(requestID), processedPrefix+time.Now().Format(time.RFC3339), s.ttl).Err()
+}
+
+// DeviceDelivered implements IdempotencyStore.
+func (s *RedisIdempotencyStore) DeviceDelivered(ctx context.Context, requestID, token string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, s.deviceKey(requestID, token)).Result()
+	return n > 0, err
+}
+
+// MarkDeviceDelivered implements IdempotencyStore.
+func (s *RedisIdempotencyStore) MarkDeviceDelivered(ctx context.Context, requestID, token, messageID string) error {
+	return s.rdb.Set(ctx, s.deviceKey(requestID, token), messageID, s.ttl).Err()
+}
+
+// Ping implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Ping(ctx context.Context) error {
+	return s.rdb.Ping(ctx).Err()
+}
@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// processUntilExit runs ProcessMessage in its own goroutine and waits for it to return or to be
+// killed with runtime.Goexit, which stands in for the pod dying: nothing after the crash point runs.
+func (tw *testWorker) processUntilExit(t *testing.T, job models.PushNotificationJob) *fakeAcknowledger {
+	t.Helper()
+	body, _ := json.Marshal(job)
+	ack := &fakeAcknowledger{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Body: body})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessMessage did not return")
+	}
+	return ack
+}
+
+// jobKey is the Redis key the worker's store keeps a job's state under.
+func (tw *testWorker) jobKey(requestID string) string {
+	return tw.Config.IdempotencyPrefix + requestID
+}
+
+func TestCrashBetweenLookupAndSendIsRedelivered(t *testing.T) {
+	var sends, crashes atomic.Int32
+	provider := &fakeProvider{name: "fcm", send: func(msg models.PushMessage) (string, error) {
+		if crashes.Add(1) == 1 {
+			runtime.Goexit() // The user and template lookups are done; the pod dies before sending.
+		}
+		sends.Add(1)
+		return "msg-1", nil
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+	job := models.PushNotificationJob{RequestID: "r-crash", UserID: "u-1", TemplateID: "welcome"}
+
+	// 1. The first attempt dies mid-flight: the delivery is never acked and the lease stays behind.
+	if got := tw.processUntilExit(t, job).get(); got != "" {
+		t.Fatalf("crashed attempt settled the delivery (%q)", got)
+	}
+	if v, _ := tw.redis.Get(tw.jobKey(job.RequestID)); !strings.HasPrefix(v, processingPrefix) {
+		t.Fatalf("job key = %q, want a processing lease", v)
+	}
+
+	// 2. RabbitMQ redelivers the unacked message at once. It must not be acked as a duplicate:
+	// it is parked in the shortest retry tier until the lease expires.
+	if got := tw.processUntilExit(t, job).get(); got != "ack" {
+		t.Fatalf("redelivery during the lease = %q, want ack after parking", got)
+	}
+	if n := len(tw.pub.byKey("push.queue.retry.5s")); n != 1 {
+		t.Fatalf("%d copies parked in the 5s tier, want 1", n)
+	}
+	if sends.Load() != 0 {
+		t.Fatal("job was sent while another worker held the lease")
+	}
+
+	// 3. Once the crashed worker's lease expires, the parked copy is processed normally.
+	tw.redis.FastForward(tw.Config.ProcessingLeaseTTL + time.Second)
+	if got := tw.processUntilExit(t, job).get(); got != "ack" {
+		t.Fatalf("redelivery after lease expiry = %q, want ack", got)
+	}
+	if sends.Load() != 1 {
+		t.Fatalf("sent %d times, want 1", sends.Load())
+	}
+	if v, _ := tw.redis.Get(tw.jobKey(job.RequestID)); !strings.HasPrefix(v, processedPrefix) {
+		t.Fatalf("job key = %q, want a processed record", v)
+	}
+	if ttl := tw.redis.TTL(tw.jobKey(job.RequestID)); ttl != tw.Config.IdempotencyTTL {
+		t.Errorf("processed record TTL = %s, want %s", ttl, tw.Config.IdempotencyTTL)
+	}
+
+	// 4. Any later copy is a true duplicate.
+	if got := tw.processUntilExit(t, job).get(); got != "ack" || sends.Load() != 1 {
+		t.Fatalf("duplicate = %q with %d sends, want ack without sending", got, sends.Load())
+	}
+}
+
+func TestFailedAttemptReleasesLease(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-retry", UserID: "u-1", TemplateID: "welcome"})
+	if tw.redis.Exists(tw.jobKey("r-retry")) {
+		t.Error("lease kept after a transient failure; the retry would be parked instead of processed")
+	}
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-dlq", UserID: "u-1", TemplateID: "welcome", RetryCount: 5})
+	if tw.redis.Exists(tw.jobKey("r-dlq")) {
+		t.Error("lease kept after dead-lettering; a DLQ replay would be parked")
+	}
+}
+
+func TestLegacyProcessedValueIsDuplicate(t *testing.T) {
+	var sends atomic.Int32
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		sends.Add(1)
+		return "id", nil
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+	// Keys written before leases existed hold a bare timestamp.
+	tw.redis.Set(tw.jobKey("r-old"), time.Now().Format(time.RFC3339))
+
+	if got := tw.process(t, models.PushNotificationJob{RequestID: "r-old", UserID: "u-1", TemplateID: "welcome"}).get(); got != "ack" {
+		t.Fatalf("outcome = %q, want ack", got)
+	}
+	if sends.Load() != 0 {
+		t.Error("job with a legacy processed key was sent again")
+	}
+}
+
+func TestReleaseLeaseOnlyDropsOwnLease(t *testing.T) {
+	ctx := context.Background()
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices())
+
+	stale, state, _ := tw.Idempotency.Acquire(ctx, "r-1")
+	if state != LeaseAcquired {
+		t.Fatalf("state = %s", state)
+	}
+	tw.redis.FastForward(tw.Config.ProcessingLeaseTTL + time.Second)
+	if _, state, _ := tw.Idempotency.Acquire(ctx, "r-1"); state != LeaseAcquired {
+		t.Fatalf("expired lease not re-acquirable: %s", state)
+	}
+
+	// The first worker wakes up late and fails: it must not free the new owner's lease.
+	tw.releaseLease(ctx, stale)
+	if _, state, _ := tw.Idempotency.Acquire(ctx, "r-1"); state != LeaseInFlight {
+		t.Errorf("state after stale release = %s, want %s", state, LeaseInFlight)
+	}
+}
+
+func TestKeepLeaseAliveRenewsLease(t *testing.T) {
+	ctx := context.Background()
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices())
+	tw.Config.ProcessingLeaseTTL = 150 * time.Millisecond
+	tw.Idempotency = NewIdempotencyStore(tw.Config, tw.RedisClient)
+
+	l, _, _ := tw.Idempotency.Acquire(ctx, "r-1")
+	stop := tw.keepLeaseAlive(ctx, l)
+	defer stop()
+
+	// miniredis only ages keys on FastForward; age the lease, then give the renewer time to tick.
+	tw.redis.FastForward(100 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for tw.redis.TTL(tw.jobKey(l.RequestID)) <= 50*time.Millisecond {
+		if time.Now().After(deadline) {
+			t.Fatalf("lease TTL = %s, was never renewed", tw.redis.TTL(tw.jobKey(l.RequestID)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// storeUnderTest is an IdempotencyStore plus a way to move its clock forward.
+type storeUnderTest struct {
+	store   IdempotencyStore
+	advance func(time.Duration)
+}
+
+func idempotencyStores(t *testing.T, ttl, leaseTTL time.Duration) map[string]storeUnderTest {
+	mr, rdb := newTestRedis(t)
+	mem := NewMemoryIdempotencyStore(100, ttl, leaseTTL)
+	now := time.Now()
+	mem.now = func() time.Time { return now }
+	return map[string]storeUnderTest{
+		"redis":  {NewRedisIdempotencyStore(rdb, "push:processed:", ttl, leaseTTL), mr.FastForward},
+		"memory": {mem, func(d time.Duration) { now = now.Add(d) }},
+	}
+}
+
+func TestIdempotencyStoreContract(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range idempotencyStores(t, time.Hour, 30*time.Second) {
+		t.Run(name, func(t *testing.T) {
+			l, state, err := s.store.Acquire(ctx, "r-1")
+			if err != nil || state != LeaseAcquired || l == nil {
+				t.Fatalf("first acquire = %v, %s, %v", l, state, err)
+			}
+			if _, state, _ := s.store.Acquire(ctx, "r-1"); state != LeaseInFlight {
+				t.Fatalf("second acquire = %s, want %s", state, LeaseInFlight)
+			}
+
+			// Renewal keeps the lease past its original TTL.
+			s.advance(20 * time.Second)
+			if ok, err := s.store.Renew(ctx, l); !ok || err != nil {
+				t.Fatalf("renew = %t, %v", ok, err)
+			}
+			s.advance(20 * time.Second)
+			if _, state, _ := s.store.Acquire(ctx, "r-1"); state != LeaseInFlight {
+				t.Fatalf("renewed lease expired: %s", state)
+			}
+
+			// Release frees the job for a retry.
+			if err := s.store.Release(ctx, l); err != nil {
+				t.Fatal(err)
+			}
+			l, state, _ = s.store.Acquire(ctx, "r-1")
+			if state != LeaseAcquired {
+				t.Fatalf("acquire after release = %s", state)
+			}
+
+			// Device records survive the job's lease.
+			if ok, _ := s.store.DeviceDelivered(ctx, "r-1", "tok-1"); ok {
+				t.Fatal("device delivered before being marked")
+			}
+			s.store.MarkDeviceDelivered(ctx, "r-1", "tok-1", "msg-1")
+			if ok, _ := s.store.DeviceDelivered(ctx, "r-1", "tok-1"); !ok {
+				t.Fatal("device delivery not recorded")
+			}
+			if ok, _ := s.store.DeviceDelivered(ctx, "r-1", "tok-2"); ok {
+				t.Fatal("other device reported as delivered")
+			}
+
+			// A processed job is a duplicate until the TTL runs out; the old lease cannot touch it.
+			s.store.MarkProcessed(ctx, "r-1")
+			if ok, _ := s.store.Renew(ctx, l); ok {
+				t.Error("lease renewed over a processed record")
+			}
+			s.store.Release(ctx, l)
+			if _, state, _ := s.store.Acquire(ctx, "r-1"); state != LeaseProcessed {
+				t.Fatalf("acquire after processing = %s, want %s", state, LeaseProcessed)
+			}
+			s.advance(time.Hour + time.Second)
+			if _, state, _ := s.store.Acquire(ctx, "r-1"); state != LeaseAcquired {
+				t.Fatalf("processed record outlived its TTL: %s", state)
+			}
+			if err := s.store.Ping(ctx); err != nil {
+				t.Errorf("ping: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryIdempotencyStoreEvictsOldestRecords(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryIdempotencyStore(2, time.Hour, time.Minute)
+	for _, id := range []string{"r-1", "r-2", "r-3"} {
+		s.MarkProcessed(ctx, id)
+	}
+	if _, state, _ := s.Acquire(ctx, "r-1"); state != LeaseAcquired {
+		t.Errorf("r-1 = %s, want evicted", state)
+	}
+	if _, state, _ := s.Acquire(ctx, "r-3"); state != LeaseProcessed {
+		t.Errorf("r-3 = %s, want %s", state, LeaseProcessed)
+	}
+}
+
+func TestIdempotencyFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		want      string // Delivery outcome
+		wantSends int32
+		wantPark  int
+		wantPause bool
+	}{
+		{FailOpen, "ack", 1, 0, false},
+		{FailClosed, "ack", 0, 1, false},
+		{FailPause, "requeue", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var sends atomic.Int32
+			provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+				sends.Add(1)
+				return "id", nil
+			}}
+			tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+			tw.Config.IdempotencyFailurePolicy = tt.policy
+			tw.redis.Close() // Redis is down
+
+			got := tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"}).get()
+			if got != tt.want {
+				t.Errorf("outcome = %q, want %q", got, tt.want)
+			}
+			if sends.Load() != tt.wantSends {
+				t.Errorf("sent %d times, want %d", sends.Load(), tt.wantSends)
+			}
+			if n := len(tw.pub.byKey("push.queue.retry.5s")); n != tt.wantPark {
+				t.Errorf("%d copies parked, want %d", n, tt.wantPark)
+			}
+			if tw.storeDown.Load() != tt.wantPause {
+				t.Errorf("consumption paused = %t, want %t", tw.storeDown.Load(), tt.wantPause)
+			}
+		})
+	}
+}
+
+func TestWaitForIdempotencyStoreResumesWhenReachable(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices())
+	tw.storeDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tw.WaitForIdempotencyStore(ctx)
+	if ctx.Err() != nil || tw.storeDown.Load() {
+		t.Fatal("consumption did not resume although the store is reachable")
+	}
+}
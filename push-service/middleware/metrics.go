@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sony/gobreaker"
+)
+
+// Metrics are the worker's Prometheus metrics. Each worker has its own registry, served by Handler.
+//
+// Every consumed delivery ends up in exactly one of the succeeded, failed, retried, dead-lettered
+// and skipped counters. Failure counters are labelled by reason (the Failure* step that failed),
+// class (models.ErrorClass) and provider (the provider whose devices failed, "multiple" or "none");
+// skipped deliveries by why the job was not processed. Provider counters are labelled by provider
+// and result, which is "success" or the error class of the device.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	jobsConsumed     prometheus.Counter
+	jobsSucceeded    prometheus.Counter
+	jobsFailed       *prometheus.CounterVec // Gave up on and dropped, with nothing to deliver
+	jobsRetried      *prometheus.CounterVec
+	jobsDeadLettered *prometheus.CounterVec
+	jobsSkipped      *prometheus.CounterVec // Settled without processing, by one of the skip* reasons
+	jobsInFlight     prometheus.Gauge
+
+	userLookupSeconds     prometheus.Histogram
+	templateLookupSeconds prometheus.Histogram
+	renderSeconds         prometheus.Histogram
+	providerSendSeconds   *prometheus.HistogramVec // One SendBatch call, by provider
+	providerSends         *prometheus.CounterVec   // Per device, by provider and result
+	breakerState          *prometheus.GaugeVec     // 0 closed, 1 half-open, 2 open
+
+	retryAfterJobs      *prometheus.CounterVec // Jobs delayed by a provider's Retry-After, by provider
+	retryAfterSeconds   *prometheus.CounterVec // Back-off providers asked for, by provider
+	throttlePauses      *prometheus.CounterVec // Global consumption pauses started or extended, by provider
+	throttleWaitSeconds prometheus.Counter     // Time this instance spent not consuming because of the global throttle
+}
+
+// NewMetrics creates the metrics and registers them, with the Go runtime and process metrics,
+// in a new registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		jobsConsumed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "push_jobs_consumed_total", Help: "Deliveries taken from the push queue.",
+		}),
+		jobsSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "push_jobs_succeeded_total", Help: "Jobs delivered to at least one device.",
+		}),
+		jobsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_jobs_failed_total", Help: "Jobs given up on and dropped because there was nothing to deliver.",
+		}, []string{"reason", "class", "provider"}),
+		jobsRetried: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_jobs_retried_total", Help: "Jobs scheduled for a retry.",
+		}, []string{"reason", "class", "provider"}),
+		jobsDeadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_jobs_dead_lettered_total", Help: "Jobs sent to the DLQ.",
+		}, []string{"reason", "class", "provider"}),
+		jobsSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_jobs_skipped_total", Help: "Deliveries settled without processing the job: duplicates, parked or requeued copies.",
+		}, []string{"reason"}),
+		jobsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "push_jobs_in_flight", Help: "Jobs the worker pool is processing right now.",
+		}),
+
+		userLookupSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "push_user_lookup_duration_seconds", Help: "User Service lookup latency.", Buckets: prometheus.DefBuckets,
+		}),
+		templateLookupSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "push_template_lookup_duration_seconds", Help: "Template Service lookup latency.", Buckets: prometheus.DefBuckets,
+		}),
+		renderSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "push_render_duration_seconds", Help: "Template rendering time.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8), // 100µs to 1.6s
+		}),
+		providerSendSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "push_provider_send_duration_seconds", Help: "Provider send latency, per batch.", Buckets: prometheus.DefBuckets,
+		}, []string{"provider"}),
+		providerSends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_provider_sends_total", Help: "Device sends by provider and result.",
+		}, []string{"provider", "result"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "push_circuit_breaker_state", Help: "Provider circuit breaker state: 0 closed, 1 half-open, 2 open.",
+		}, []string{"provider"}),
+
+		retryAfterJobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_retry_after_jobs_total", Help: "Jobs delayed by a provider's Retry-After.",
+		}, []string{"provider"}),
+		retryAfterSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_retry_after_seconds_total", Help: "Back-off providers asked for.",
+		}, []string{"provider"}),
+		throttlePauses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "push_throttle_pauses_total", Help: "Global consumption pauses started or extended.",
+		}, []string{"provider"}),
+		throttleWaitSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "push_throttle_wait_seconds_total", Help: "Time spent not consuming because of the global throttle.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.jobsConsumed, m.jobsSucceeded, m.jobsFailed, m.jobsRetried, m.jobsDeadLettered, m.jobsSkipped, m.jobsInFlight,
+		m.userLookupSeconds, m.templateLookupSeconds, m.renderSeconds, m.providerSendSeconds, m.providerSends, m.breakerState,
+		m.retryAfterJobs, m.retryAfterSeconds, m.throttlePauses, m.throttleWaitSeconds,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Values of the jobsSkipped reason label.
+const (
+	skipDuplicate        = "duplicate"         // Already processed; the copy was acked
+	skipInFlight         = "in_flight"         // Leased by another worker; the copy was parked
+	skipStoreUnavailable = "store_unavailable" // Idempotency store down under the closed or pause policy
+	skipAborted          = "aborted"           // Requeued by a shutdown that ran out of time
+)
+
+// since observes the time elapsed since start on h.
+func since(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// setBreakerState records a provider circuit breaker's state.
+func (m *Metrics) setBreakerState(provider string, state gobreaker.State) {
+	// gobreaker's states are 0 closed, 1 half-open, 2 open.
+	m.breakerState.WithLabelValues(provider).Set(float64(state))
+}
+
+// jobFailed counts a job given up on, as dead-lettered or as dropped.
+func (m *Metrics) jobFailed(reason, class, provider string, deadLettered bool) {
+	if class == "" {
+		class = "unknown"
+	}
+	if deadLettered {
+		m.jobsDeadLettered.WithLabelValues(reason, class, provider).Inc()
+		return
+	}
+	m.jobsFailed.WithLabelValues(reason, class, provider).Inc()
+}
@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+	"github.com/streadway/amqp"
+)
+
+// scrape returns the worker's /metrics page.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestMetricsCountSuccessfulJob(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1", "tok-2"))
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+
+	m := tw.Metrics
+	if got := testutil.ToFloat64(m.jobsConsumed); got != 1 {
+		t.Errorf("consumed = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.jobsSucceeded); got != 1 {
+		t.Errorf("succeeded = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.providerSends.WithLabelValues("fcm", "success")); got != 2 {
+		t.Errorf("fcm successes = %v, want 2", got)
+	}
+	if got := testutil.CollectAndCount(m.jobsFailed); got != 0 {
+		t.Errorf("%d failure series, want none", got)
+	}
+
+	page := scrape(t, m)
+	for _, want := range []string{
+		"push_user_lookup_duration_seconds_count 1",
+		"push_template_lookup_duration_seconds_count 1",
+		"push_render_duration_seconds_count 1",
+		`push_provider_send_duration_seconds_count{provider="fcm"} 1`,
+		`push_circuit_breaker_state{provider="fcm"} 0`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+}
+
+func TestMetricsCountFailuresByReasonClassAndProvider(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	tw.process(t, models.PushNotificationJob{RequestID: "r-2", UserID: "u-1", TemplateID: "welcome", RetryCount: 5})
+
+	m := tw.Metrics
+	if got := testutil.ToFloat64(m.providerSends.WithLabelValues("fcm", "transient")); got != 1 {
+		t.Errorf("fcm transient failures = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.jobsRetried.WithLabelValues(FailureDelivery, "transient", "fcm")); got != 1 {
+		t.Errorf("retried = %v, want 1", got)
+	}
+	// No failure headers on the second job, so the class and provider of its last attempt are unknown.
+	if got := testutil.ToFloat64(m.jobsDeadLettered.WithLabelValues(FailureMaxRetries, "unknown", providerNone)); got != 1 {
+		t.Errorf("dead-lettered = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.jobsFailed); got != 0 {
+		t.Errorf("%d failure series, want none: dead-lettered jobs are counted apart", got)
+	}
+	if got := testutil.ToFloat64(m.jobsSucceeded); got != 0 {
+		t.Errorf("succeeded = %v, want 0", got)
+	}
+
+	// The retry copy carries the provider to the attempt that runs out of retries.
+	retry := tw.pub.byKey("push.queue.retry.5s")[0]
+	var job models.PushNotificationJob
+	json.Unmarshal(retry, &job)
+	job.RetryCount = 5
+	body, _ := json.Marshal(job)
+	headers := amqp.Table{HeaderFailureClass: "transient", HeaderFailureProvider: "fcm"}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Headers: headers, Body: body})
+	if got := testutil.ToFloat64(m.jobsDeadLettered.WithLabelValues(FailureMaxRetries, "transient", "fcm")); got != 1 {
+		t.Errorf("dead-lettered after the last fcm attempt = %v, want 1", got)
+	}
+}
+
+func TestMetricsAccountForEveryConsumedJob(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+	ctx := context.Background()
+	if _, _, err := tw.Idempotency.Acquire(ctx, "r-leased"); err != nil {
+		t.Fatal(err)
+	}
+	aborted, abort := context.WithCancel(ctx)
+	abort()
+
+	jobs := []struct {
+		ctx  context.Context
+		body string
+	}{
+		{ctx, `{"request_id":"r-1","user_id":"u-1","template_id":"welcome"}`},                 // succeeded
+		{ctx, `{"request_id":"r-1","user_id":"u-1","template_id":"welcome"}`},                 // duplicate
+		{ctx, `{"request_id":"r-leased","user_id":"u-1","template_id":"welcome"}`},            // in flight
+		{ctx, `{"request_id":"r-2","user_id":"u-1","template_id":"welcome","retry_count":5}`}, // dead-lettered
+		{ctx, `not json`}, // dead-lettered
+		{aborted, `{"request_id":"r-3","user_id":"u-1","template_id":"welcome"}`}, // aborted
+	}
+	for _, j := range jobs {
+		tw.ProcessMessage(j.ctx, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(j.body)})
+	}
+
+	m := tw.Metrics
+	consumed := testutil.ToFloat64(m.jobsConsumed)
+	settled := testutil.ToFloat64(m.jobsSucceeded) + sum(t, m, "push_jobs_failed_total") + sum(t, m, "push_jobs_retried_total") +
+		sum(t, m, "push_jobs_dead_lettered_total") + sum(t, m, "push_jobs_skipped_total")
+	if consumed != float64(len(jobs)) || settled != consumed {
+		t.Errorf("consumed %v, settled %v; want %d of each", consumed, settled, len(jobs))
+	}
+	for reason, want := range map[string]float64{skipDuplicate: 1, skipInFlight: 1, skipAborted: 1} {
+		if got := testutil.ToFloat64(m.jobsSkipped.WithLabelValues(reason)); got != want {
+			t.Errorf("skipped as %s = %v, want %v", reason, got, want)
+		}
+	}
+}
+
+// sum adds up every series of the named counter.
+func sum(t *testing.T, m *Metrics, name string) float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for _, f := range families {
+		if f.GetName() == name {
+			for _, metric := range f.GetMetric() {
+				total += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return total
+}
+
+func TestMetricsTrackBreakerState(t *testing.T) {
+	m := NewMetrics()
+	m.setBreakerState("apns", gobreaker.StateOpen)
+	if got := testutil.ToFloat64(m.breakerState.WithLabelValues("apns")); got != 2 {
+		t.Errorf("breaker state = %v, want 2 (open)", got)
+	}
+}
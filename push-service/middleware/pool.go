@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// WorkerPool processes deliveries on a fixed number of goroutines. Each goroutine only takes the
+// next delivery once it is done with the current one, so a slow provider backs up into RabbitMQ
+// (bounded by the channel prefetch) instead of into unbounded goroutines.
+type WorkerPool struct {
+	worker *PushWorker
+	size   int
+}
+
+// NewWorkerPool creates a pool running size concurrent jobs on the worker.
+func NewWorkerPool(w *PushWorker, size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{worker: w, size: size}
+}
+
+// Run consumes deliveries until msgs is closed or drain is cancelled, then waits for every
+// in-flight job to finish. ctx is handed to every job; cancelling it aborts in-flight work.
+// Cancelling drain stops the goroutines from taking another delivery, including while they wait
+// out a throttle pause or an idempotency store outage.
+func (p *WorkerPool) Run(ctx, drain context.Context, msgs <-chan amqp.Delivery) {
+	p.worker.Logger.Info("Starting push workers.", "workers", p.size)
+	var wg sync.WaitGroup
+	for i := 0; i < p.size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Hold off while a provider has asked every worker to back off, and while the
+				// idempotency store is down under the pause policy. Waiting before the receive
+				// leaves the deliveries with the consumer, which requeues them on a drain.
+				p.worker.Throttle.Wait(drain, p.worker.Logger)
+				p.worker.WaitForIdempotencyStore(drain)
+				if drain.Err() != nil {
+					return
+				}
+
+				select {
+				case <-drain.Done():
+					return
+				case d, ok := <-msgs:
+					if !ok {
+						return
+					}
+					p.worker.Metrics.jobsInFlight.Inc()
+					p.worker.ProcessMessage(ctx, d)
+					p.worker.Metrics.jobsInFlight.Dec()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
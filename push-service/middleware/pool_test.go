@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// deliveries queues n distinct jobs on a closed channel, like a consumer whose channel was closed
+// after the last delivery.
+func deliveries(n int) (<-chan amqp.Delivery, []*fakeAcknowledger) {
+	msgs := make(chan amqp.Delivery, n)
+	acks := make([]*fakeAcknowledger, n)
+	for i := range acks {
+		body, _ := json.Marshal(models.PushNotificationJob{RequestID: fmt.Sprintf("r-%d", i), UserID: "u-1", TemplateID: "welcome"})
+		acks[i] = &fakeAcknowledger{}
+		msgs <- amqp.Delivery{Acknowledger: acks[i], Body: body}
+	}
+	close(msgs)
+	return msgs, acks
+}
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return "id", nil
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	msgs, acks := deliveries(20)
+	NewWorkerPool(tw.PushWorker, 4).Run(context.Background(), context.Background(), msgs)
+
+	for i, ack := range acks {
+		if ack.get() != "ack" {
+			t.Fatalf("delivery %d = %q, want ack", i, ack.get())
+		}
+	}
+	if p := peak.Load(); p != 4 {
+		t.Errorf("peak concurrency = %d, want 4", p)
+	}
+}
+
+// BenchmarkWorkerPool measures throughput at different pool sizes against a provider that takes
+// 2ms per send, roughly an FCM round trip from the same region.
+func BenchmarkWorkerPool(b *testing.B) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		time.Sleep(2 * time.Millisecond)
+		return "id", nil
+	}}
+	for _, size := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("concurrency=%d", size), func(b *testing.B) {
+			tw := newTestWorker(b, provider, userWithDevices("tok-1"))
+			msgs, _ := deliveries(b.N)
+			b.ResetTimer()
+			NewWorkerPool(tw.PushWorker, size).Run(context.Background(), context.Background(), msgs)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "jobs/s")
+		})
+	}
+}
+
+func TestAbortedJobIsRequeuedWithoutRetry(t *testing.T) {
+	ctx, abort := context.WithCancel(context.Background())
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, func(w http.ResponseWriter, r *http.Request) {
+		abort() // The shutdown deadline passes while the user lookup is in flight.
+		<-r.Context().Done()
+	})
+
+	body, _ := json.Marshal(models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(ctx, amqp.Delivery{Acknowledger: ack, Body: body})
+
+	if ack.get() != "requeue" {
+		t.Errorf("outcome = %q, want requeue", ack.get())
+	}
+	if n := len(tw.pub.byKey("push.queue.retry.5s")); n != 0 {
+		t.Errorf("%d retries scheduled for an aborted job, want 0", n)
+	}
+	if tw.redis.Exists(tw.jobKey("r-1")) {
+		t.Error("lease kept after abort; the redelivery would be parked")
+	}
+}
+
+func TestShutdownDuringPauseDrains(t *testing.T) {
+	tests := []struct {
+		name  string
+		pause func(tw *testWorker)
+	}{
+		{"throttle pause", func(tw *testWorker) {
+			if _, err := tw.Throttle.Pause(context.Background(), "fcm", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"idempotency store outage", func(tw *testWorker) {
+			tw.storeDown.Store(true)
+			tw.redis.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+			tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+			tt.pause(tw)
+
+			msgs := make(chan amqp.Delivery, 1)
+			ack := &fakeAcknowledger{}
+			msgs <- amqp.Delivery{Acknowledger: ack, Body: []byte(`{"request_id":"r-1"}`)}
+			drain, stop := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				NewWorkerPool(tw.PushWorker, 2).Run(context.Background(), drain, msgs)
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			stop()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("pool still waiting after the drain started")
+			}
+			if len(msgs) != 1 || ack.get() != "" {
+				t.Errorf("delivery taken during the pause (outcome %q), want it left for the consumer to requeue", ack.get())
+			}
+		})
+	}
+}
+
+func TestAbortedLeaseLookupDoesNotPauseConsumption(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices("tok-1"))
+	tw.Config.IdempotencyFailurePolicy = FailPause
+	ctx, abort := context.WithCancel(context.Background())
+	abort()
+
+	body, _ := json.Marshal(models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(ctx, amqp.Delivery{Acknowledger: ack, Body: body})
+
+	if ack.get() != "requeue" {
+		t.Errorf("outcome = %q, want requeue", ack.get())
+	}
+	if tw.storeDown.Load() {
+		t.Error("idempotency store marked down by an aborted job")
+	}
+}
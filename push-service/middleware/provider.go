@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ezrahel/models"
+	"github.com/sony/gobreaker"
+)
+
+// PushProvider is implemented by every push delivery backend (FCM, APNs, Web Push, ...).
+// The worker only talks to this interface, so new backends can be added without touching ProcessMessage.
+type PushProvider interface {
+	// Name identifies the provider in logs and routing decisions (e.g. "fcm").
+	Name() string
+	// Send delivers a single message and returns the provider's message ID.
+	Send(ctx context.Context, msg models.PushMessage) (string, error)
+	// SendBatch delivers several messages and reports a result per message.
+	// The returned error is only set when the whole batch could not be attempted.
+	SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error)
+	// ClassifyError maps an error returned by Send or SendBatch to an ErrorClass.
+	ClassifyError(err error) models.ErrorClass
+	// IsTokenInvalid reports whether the error means the device token is dead
+	// (unregistered, uninstalled, expired subscription) and should be pruned.
+	IsTokenInvalid(err error) bool
+	// RetryAfter returns how long the backend asked us to back off (Retry-After, quota resets),
+	// or zero when the error carries no such hint.
+	RetryAfter(err error) time.Duration
+}
+
+// RegisterProvider makes a delivery backend available to the worker and gives it its own circuit breaker,
+// so an APNs outage does not stop FCM deliveries.
+func (w *PushWorker) RegisterProvider(p PushProvider) {
+	w.Providers[p.Name()] = p
+	w.Breakers[p.Name()] = w.newDeliveryBreaker(p)
+	w.Metrics.setBreakerState(p.Name(), gobreaker.StateClosed)
+}
+
+// providerFor picks the backend for one device. An explicit provider on the job wins, then the
+// device's and the user's preferred provider. Otherwise browser subscriptions go to Web Push and
+// iOS devices go straight to APNs when those are configured, and everything else uses the default provider.
+func (w *PushWorker) providerFor(job models.PushNotificationJob, user models.UserData, device models.Device) (PushProvider, error) {
+	for _, name := range []string{job.Provider, device.Provider, user.Provider} {
+		if name == "" {
+			continue
+		}
+		p, ok := w.Providers[name]
+		if !ok {
+			return nil, fmt.Errorf("push provider %q is not configured", name)
+		}
+		return p, nil
+	}
+
+	if device.Subscription != nil {
+		if p, ok := w.Providers["webpush"]; ok {
+			return p, nil
+		}
+	}
+	if device.Platform == models.PlatformIOS {
+		if p, ok := w.Providers["apns"]; ok {
+			return p, nil
+		}
+	}
+	return w.Provider, nil
+}
+
+// newDeliveryBreaker builds the circuit breaker protecting a single push provider. The trip
+// thresholds follow Reconfigure; the open timeout and half-open probes are fixed at creation.
+func (w *PushWorker) newDeliveryBreaker(p PushProvider) *gobreaker.CircuitBreaker {
+	m := w.Metrics
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        p.Name() + "DeliveryBreaker",
+		MaxRequests: uint32(w.Config.BreakerHalfOpenRequests),
+		Timeout:     w.Config.BreakerOpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			// Trip once BreakerFailureRatio of at least BreakerMinRequests requests failed.
+			s := w.Settings()
+			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
+			return counts.Requests >= uint32(s.BreakerMinRequests) && failureRatio >= s.BreakerFailureRatio
+		},
+		IsSuccessful: func(err error) bool {
+			// A dead device token says nothing about the provider's health.
+			return err == nil || p.ClassifyError(err) == models.ErrorClassPermanent
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			w.Logger.Warn("Circuit breaker changed state.", "breaker", name, "from", from.String(), "to", to.String())
+			m.setBreakerState(p.Name(), to)
+		},
+	})
+}
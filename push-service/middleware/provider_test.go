@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+)
+
+func TestProviderForPicksByJobDeviceUserThenPlatform(t *testing.T) {
+	ok := func(models.PushMessage) (string, error) { return "id", nil }
+	tw := newTestWorker(t, &fakeProvider{name: "fcm", send: ok}, userWithDevices("tok-1"))
+	for _, name := range []string{"apns", "webpush", "onesignal"} {
+		tw.RegisterProvider(&fakeProvider{name: name, send: ok})
+	}
+
+	android := models.Device{Token: "a", Platform: models.PlatformAndroid}
+	ios := models.Device{Token: "i", Platform: models.PlatformIOS}
+	browser := models.Device{Token: "w", Platform: models.PlatformWeb, Subscription: &models.WebPushSubscription{Endpoint: "https://push.example.com/w"}}
+
+	tests := []struct {
+		name   string
+		job    string // Job override
+		device models.Device
+		user   string // User preference
+		want   string
+	}{
+		{name: "default", device: android, want: "fcm"},
+		{name: "ios goes to apns", device: ios, want: "apns"},
+		{name: "browser goes to webpush", device: browser, want: "webpush"},
+		{name: "user preference", device: android, user: "onesignal", want: "onesignal"},
+		{name: "user preference over platform", device: ios, user: "onesignal", want: "onesignal"},
+		{name: "device preference over user", device: withProvider(android, "apns"), user: "onesignal", want: "apns"},
+		{name: "job override over device and user", job: "fcm", device: withProvider(ios, "apns"), user: "onesignal", want: "fcm"},
+	}
+	for _, tt := range tests {
+		p, err := tw.providerFor(models.PushNotificationJob{Provider: tt.job}, models.UserData{Provider: tt.user}, tt.device)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.Name() != tt.want {
+			t.Errorf("%s: provider = %s, want %s", tt.name, p.Name(), tt.want)
+		}
+	}
+}
+
+func TestProviderForFallsBackWithoutPlatformProviders(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices("tok-1"))
+
+	// Without APNs and Web Push registered, iOS and browser devices use the default provider.
+	for _, device := range []models.Device{
+		{Token: "i", Platform: models.PlatformIOS},
+		{Token: "w", Platform: models.PlatformWeb, Subscription: &models.WebPushSubscription{Endpoint: "https://push.example.com/w"}},
+	} {
+		if p, err := tw.providerFor(models.PushNotificationJob{}, models.UserData{}, device); err != nil || p.Name() != "fcm" {
+			t.Errorf("%s device: provider = %v, err = %v, want fcm", device.Platform, p, err)
+		}
+	}
+}
+
+func TestProviderForRejectsUnconfiguredProvider(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices("tok-1"))
+	device := models.Device{Token: "a", Platform: models.PlatformAndroid}
+
+	tests := []struct {
+		name string
+		job  models.PushNotificationJob
+		dev  models.Device
+		user models.UserData
+	}{
+		{name: "job", job: models.PushNotificationJob{Provider: "onesignal"}, dev: device},
+		{name: "device", dev: withProvider(device, "onesignal")},
+		{name: "user", dev: device, user: models.UserData{Provider: "onesignal"}},
+	}
+	for _, tt := range tests {
+		_, err := tw.providerFor(tt.job, tt.user, tt.dev)
+		if err == nil || !strings.Contains(err.Error(), `push provider "onesignal" is not configured`) {
+			t.Errorf("%s preference: err = %v", tt.name, err)
+		}
+	}
+
+	// The device is reported as a permanent failure; retrying will not configure the provider.
+	tw = newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices("tok-1"))
+	out := tw.deliverToDevices(t.Context(), models.PushNotificationJob{Provider: "onesignal"}, models.UserData{Devices: []models.Device{device}}, models.PushMessage{})
+	if out.Permanent != 1 || out.Results[0].Class != models.ErrorClassPermanent {
+		t.Errorf("outcome = %+v, want a permanent failure", out)
+	}
+}
+
+func withProvider(d models.Device, provider string) models.Device {
+	d.Provider = provider
+	return d
+}
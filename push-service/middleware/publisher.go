@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher is what the worker publishes retries, parked jobs and events through.
+// Publish only returns nil once the broker has taken responsibility for the message,
+// so the worker can ack the original delivery afterwards.
+type Publisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// ErrPublishNacked is returned when the broker refused a message (for example an internal queue error).
+var ErrPublishNacked = errors.New("broker nacked the publish")
+
+// confirmBuffer leaves room for confirmations that arrive after their publish timed out. The amqp
+// library blocks the connection while a confirmation cannot be handed over.
+const confirmBuffer = 64
+
+// confirmChannel is the part of *amqp.Channel the publisher needs, so tests can stand in for the broker.
+type confirmChannel interface {
+	Confirm(noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Close() error
+}
+
+// confirmedChannel is one channel in confirm mode. Publishes on it are serialized: amqp channels
+// must not be used from several goroutines, and with one publish in flight the next confirmation
+// is easy to match to it.
+type confirmedChannel struct {
+	mu       sync.Mutex
+	ch       confirmChannel
+	confirms chan amqp.Confirmation
+	seq      uint64 // Delivery tag of the last publish; the broker numbers them from 1
+}
+
+// ConfirmPublisher publishes on channels of its own, separate from the consuming channel, with
+// publisher confirms enabled. Publishes are spread round-robin over the channels.
+type ConfirmPublisher struct {
+	channels []*confirmedChannel
+	next     atomic.Uint64
+	timeout  time.Duration // How long to wait for the broker's confirmation
+}
+
+// NewConfirmPublisher opens n channels on conn and puts them in confirm mode.
+func NewConfirmPublisher(conn *amqp.Connection, n int, timeout time.Duration) (*ConfirmPublisher, error) {
+	chans := make([]confirmChannel, 0, n)
+	for i := 0; i < max(n, 1); i++ {
+		ch, err := conn.Channel()
+		if err != nil {
+			closeAll(chans)
+			return nil, fmt.Errorf("failed to open publisher channel: %w", err)
+		}
+		chans = append(chans, ch)
+	}
+	return newConfirmPublisher(chans, timeout)
+}
+
+func newConfirmPublisher(chans []confirmChannel, timeout time.Duration) (*ConfirmPublisher, error) {
+	p := &ConfirmPublisher{timeout: timeout}
+	for _, ch := range chans {
+		if err := ch.Confirm(false); err != nil {
+			closeAll(chans)
+			return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+		}
+		p.channels = append(p.channels, &confirmedChannel{
+			ch:       ch,
+			confirms: ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer)),
+		})
+	}
+	return p, nil
+}
+
+// Publish sends the message and waits for the broker to confirm it.
+func (p *ConfirmPublisher) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c := p.channels[(p.next.Add(1)-1)%uint64(len(p.channels))]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.ch.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", key, err)
+	}
+	c.seq++
+
+	timeout := time.NewTimer(p.timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case confirm, ok := <-c.confirms:
+			if !ok {
+				return fmt.Errorf("publisher channel closed before %s was confirmed", key)
+			}
+			if confirm.DeliveryTag < c.seq {
+				continue // Late confirmation of an earlier publish that already timed out
+			}
+			if !confirm.Ack {
+				return fmt.Errorf("publish to %s: %w", key, ErrPublishNacked)
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("no publisher confirm for %s within %s", key, p.timeout)
+		}
+	}
+}
+
+// Close closes the publisher's channels.
+func (p *ConfirmPublisher) Close() error {
+	var errs []error
+	for _, c := range p.channels {
+		if err := c.ch.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func closeAll(chans []confirmChannel) {
+	for _, ch := range chans {
+		ch.Close()
+	}
+}
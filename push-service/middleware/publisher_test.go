@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// fakeConfirmChannel plays the broker: confirm decides how each publish is answered.
+type fakeConfirmChannel struct {
+	mu        sync.Mutex
+	confirms  chan amqp.Confirmation
+	tag       uint64
+	published []string
+	confirm   func(tag uint64) (ack, answer bool)
+	closed    bool
+}
+
+func (c *fakeConfirmChannel) Confirm(noWait bool) error { return nil }
+
+func (c *fakeConfirmChannel) NotifyPublish(ch chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = ch
+	return ch
+}
+
+func (c *fakeConfirmChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tag++
+	c.published = append(c.published, key)
+	if ack, answer := c.confirm(c.tag); answer {
+		c.confirms <- amqp.Confirmation{DeliveryTag: c.tag, Ack: ack}
+	}
+	return nil
+}
+
+func (c *fakeConfirmChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestConfirmPublisherWaitsForConfirm(t *testing.T) {
+	acks := &fakeConfirmChannel{confirm: func(uint64) (bool, bool) { return true, true }}
+	nacks := &fakeConfirmChannel{confirm: func(uint64) (bool, bool) { return false, true }}
+	p, err := newConfirmPublisher([]confirmChannel{acks, nacks}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Publishes alternate between the channels.
+	if err := p.Publish("ex", "a", false, false, amqp.Publishing{}); err != nil {
+		t.Errorf("acked publish: %v", err)
+	}
+	if err := p.Publish("ex", "b", false, false, amqp.Publishing{}); !errors.Is(err, ErrPublishNacked) {
+		t.Errorf("nacked publish = %v, want ErrPublishNacked", err)
+	}
+	if len(acks.published) != 1 || len(nacks.published) != 1 {
+		t.Errorf("publishes per channel = %d/%d, want 1/1", len(acks.published), len(nacks.published))
+	}
+
+	p.Close()
+	if !acks.closed || !nacks.closed {
+		t.Error("channels left open")
+	}
+}
+
+func TestConfirmPublisherSkipsLateConfirms(t *testing.T) {
+	ch := &fakeConfirmChannel{confirm: func(tag uint64) (bool, bool) {
+		return true, tag != 1 // The broker is slow to confirm the first publish
+	}}
+	p, _ := newConfirmPublisher([]confirmChannel{ch}, 20*time.Millisecond)
+
+	if err := p.Publish("ex", "slow", false, false, amqp.Publishing{}); err == nil || !strings.Contains(err.Error(), "no publisher confirm") {
+		t.Fatalf("unconfirmed publish = %v, want a timeout", err)
+	}
+	// The first confirm shows up late; it must not be taken for the second publish's nack.
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	ch.confirm = func(uint64) (bool, bool) { return false, true }
+	if err := p.Publish("ex", "next", false, false, amqp.Publishing{}); !errors.Is(err, ErrPublishNacked) {
+		t.Errorf("second publish = %v, want its own nack", err)
+	}
+}
+
+func TestConfirmPublisherReportsClosedChannel(t *testing.T) {
+	ch := &fakeConfirmChannel{confirm: func(uint64) (bool, bool) { return false, false }}
+	p, _ := newConfirmPublisher([]confirmChannel{ch}, time.Second)
+	close(ch.confirms) // The amqp library closes notify channels when the channel goes away
+
+	if err := p.Publish("ex", "k", false, false, amqp.Publishing{}); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("publish on closed channel = %v", err)
+	}
+}
+
+func TestRetryIsNotAckedWhenPublishFails(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(msg models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+	tw.pub.err = ErrPublishNacked
+
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() == "ack" {
+		t.Fatal("original delivery acked although the retry copy was not confirmed")
+	}
+}
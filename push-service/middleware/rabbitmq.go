@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/streadway/amqp"
+)
+
+// ErrNotConnected is returned by Publish while the connection to RabbitMQ is down.
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+// Reconnect backoff: 1s, 2s, 4s, ... capped at maxReconnectDelay, with jitter so a fleet of workers
+// does not hammer a broker that just came back.
+const (
+	baseReconnectDelay = time.Second
+	maxReconnectDelay  = 30 * time.Second
+)
+
+// RabbitMQ owns the connection to the broker. It reconnects with backoff whenever the connection
+// or the consuming channel closes, re-declares the topology, and restarts the consumer. It also
+// implements Publisher on top of the current connection's confirm channels.
+type RabbitMQ struct {
+	cfg    Config
+	Logger *slog.Logger // Connection lines; defaults to slog.Default()
+
+	mu        sync.RWMutex
+	publisher *ConfirmPublisher  // nil while disconnected
+	lastErr   error              // Why the last connection attempt failed or the connection was lost
+	restart   context.CancelFunc // Drains the current session so Run reconnects right away
+	prefetch  atomic.Int64       // cfg.PrefetchCount until Reconsume
+	ready     atomic.Bool
+}
+
+// NewRabbitMQ creates the connection manager. Nothing is dialed until Run.
+func NewRabbitMQ(cfg Config) *RabbitMQ {
+	r := &RabbitMQ{cfg: cfg, Logger: slog.Default()}
+	r.prefetch.Store(int64(cfg.PrefetchCount))
+	return r
+}
+
+// Reconsume restarts the consumer with a new prefetch count: the current consumer is cancelled and
+// drained like on shutdown, then Run reconnects at once and calls consume again. RabbitMQ only
+// applies a new prefetch to new consumers, and consume picks up a new pool size the same way.
+func (r *RabbitMQ) Reconsume(prefetch int) {
+	r.prefetch.Store(int64(prefetch))
+	r.mu.RLock()
+	restart := r.restart
+	r.mu.RUnlock()
+	if restart != nil {
+		restart()
+	}
+}
+
+// Ready reports whether the worker is connected and consuming.
+func (r *RabbitMQ) Ready() bool {
+	return r.ready.Load()
+}
+
+// Connected reports whether there is a connection to publish on. While disconnected, err says why.
+func (r *RabbitMQ) Connected() (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.publisher != nil, r.lastErr
+}
+
+// Publish implements Publisher on the current connection.
+func (r *RabbitMQ) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	r.mu.RLock()
+	p := r.publisher
+	r.mu.RUnlock()
+	if p == nil {
+		return ErrNotConnected
+	}
+	return p.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+// Run connects and hands the consumer's deliveries to consume, which must return once the
+// deliveries channel is closed. When the connection drops, Run reconnects with backoff.
+// The context passed to consume is cancelled as soon as the drain starts, so consume can stop
+// waiting for its next delivery.
+//
+// Cancelling ctx starts a drain: the consumer is cancelled so the broker stops sending, deliveries
+// already buffered are requeued, and Run returns once consume has finished its in-flight jobs and
+// the connection is closed. Acks of those jobs still go out on the open connection.
+//
+// Reconsume drains the consumer the same way, then Run reconnects without waiting.
+//
+// Run only returns an error when the broker's topology does not match the spec (ErrTopologyMismatch).
+func (r *RabbitMQ) Run(ctx context.Context, consume func(drain context.Context, msgs <-chan amqp.Delivery)) error {
+	attempt := 0
+	for {
+		sessionCtx, restart := context.WithCancel(ctx)
+		r.mu.Lock()
+		r.restart = restart
+		r.mu.Unlock()
+		connected, err := r.session(sessionCtx, consume)
+		restarted := sessionCtx.Err() != nil
+		restart()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrTopologyMismatch) {
+			return err
+		}
+		if restarted {
+			attempt = 0
+			r.Logger.Info("Restarting the RabbitMQ consumer with the new settings.")
+			continue
+		}
+		if connected {
+			attempt = 0 // The connection worked; start the backoff over.
+		}
+		delay := reconnectDelay(attempt, rand.Float64())
+		attempt++
+		if err != nil {
+			r.setLastErr(err)
+			r.Logger.Error("RabbitMQ unavailable. Reconnecting.", log.Err(err), "delay", delay.Round(time.Millisecond))
+		} else {
+			r.Logger.Warn("RabbitMQ consumer stopped. Reconnecting.", "delay", delay.Round(time.Millisecond))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session runs one connection from dial to close. connected reports whether it got as far as consuming.
+func (r *RabbitMQ) session(ctx context.Context, consume func(drain context.Context, msgs <-chan amqp.Delivery)) (connected bool, err error) {
+	conn, err := amqp.Dial(r.cfg.RabbitMQURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	if err := r.setUpTopology(conn, ch); err != nil {
+		return false, err
+	}
+	// Prefetch bounds the unacknowledged deliveries buffered for the worker pool.
+	if err := ch.Qos(int(r.prefetch.Load()), 0, false); err != nil {
+		return false, fmt.Errorf("failed to set QoS: %w", err)
+	}
+
+	// Retries, parked jobs and events go out on dedicated confirm-mode channels. The original
+	// delivery is only acked once the broker has confirmed the copy.
+	publisher, err := NewConfirmPublisher(conn, r.cfg.PublisherChannels, r.cfg.PublishConfirmTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	tag := consumerTag()
+	msgs, err := ch.Consume(
+		r.cfg.QueueName, // queue
+		tag,             // consumer tag, needed to cancel the consumer on shutdown
+		false,           // auto-ack (set to false for explicit control over ACK/NACK/REJECT)
+		false,           // exclusive
+		false,           // no-local
+		false,           // no-wait
+		nil,             // args
+	)
+	if err != nil {
+		publisher.Close()
+		return false, fmt.Errorf("failed to register a consumer: %w", err)
+	}
+
+	r.setPublisher(publisher)
+	r.setLastErr(nil)
+	r.ready.Store(true)
+	r.Logger.Info("Connected to RabbitMQ.", "queue", r.cfg.QueueName)
+
+	// On shutdown, cancel the consumer: the broker stops sending and msgs is closed.
+	stop := context.AfterFunc(ctx, func() {
+		r.ready.Store(false)
+		if err := ch.Cancel(tag, false); err != nil {
+			r.Logger.Warn("Failed to cancel consumer.", log.Err(err))
+		}
+	})
+	defer stop()
+
+	consume(ctx, handOff(ctx, msgs))
+
+	r.ready.Store(false)
+	r.setPublisher(nil)
+	publisher.Close()
+	select {
+	case amqpErr := <-closed:
+		if amqpErr != nil {
+			r.setLastErr(amqpErr)
+			r.Logger.Error("RabbitMQ connection lost.", log.Err(amqpErr))
+		}
+	default:
+	}
+	return true, nil
+}
+
+// setUpTopology declares the topology on ch, or in verify mode only checks it.
+func (r *RabbitMQ) setUpTopology(conn *amqp.Connection, ch *amqp.Channel) error {
+	topology := r.cfg.Topology()
+	if r.cfg.TopologyMode == TopologyVerify {
+		return topology.Verify(func() (topologyChannel, error) {
+			c, err := conn.Channel()
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
+		})
+	}
+	return topology.Declare(ch)
+}
+
+// handOff passes deliveries on one at a time, so they are only taken when a worker is free. Once ctx
+// is cancelled, deliveries the client library still buffers are requeued instead of started.
+func handOff(ctx context.Context, msgs <-chan amqp.Delivery) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for d := range msgs {
+			if ctx.Err() == nil {
+				select {
+				case out <- d:
+					continue
+				case <-ctx.Done():
+				}
+			}
+			d.Nack(false, true)
+		}
+	}()
+	return out
+}
+
+// consumerTag identifies this process's consumer in the RabbitMQ management UI.
+func consumerTag() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("push-service-%s-%d", host, os.Getpid())
+}
+
+func (r *RabbitMQ) setPublisher(p *ConfirmPublisher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.publisher = p
+}
+
+func (r *RabbitMQ) setLastErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastErr = err
+}
+
+// reconnectDelay returns the backoff before reconnect attempt n (from 0), jittered by r in [0, 1).
+func reconnectDelay(attempt int, r float64) time.Duration {
+	delay := maxReconnectDelay
+	if attempt < 5 {
+		delay = min(baseReconnectDelay<<attempt, maxReconnectDelay)
+	}
+	return jitteredDelay(delay, 0.2, r)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Settings returns the worker's runtime settings: Config as started, with the changes applied by
+// Reconfigure since.
+func (w *PushWorker) Settings() Config {
+	if cfg := w.live.Load(); cfg != nil {
+		return *cfg
+	}
+	return w.Config
+}
+
+// Reconfigure applies the settings of cfg that can change while jobs are processed: retries
+// (MaxRetries, RetryDelays, RetryJitter), the throttle cap, breaker trip thresholds and disabled
+// providers. WorkerConcurrency and PrefetchCount are recorded for the next consumer; restart it
+// with RabbitMQ.Reconsume. LogLevel is recorded too; the logger's *slog.LevelVar belongs to whoever
+// created it. Everything else in cfg is ignored.
+//
+// Retry tiers are queues declared at startup, so the new schedule may only use delays of the
+// schedule the worker started with. When it uses any other delay, the running schedule is kept,
+// everything else is applied, and the error is a *NotReloadedError saying why.
+func (w *PushWorker) Reconfigure(cfg Config) error {
+	next := w.Settings()
+	next.WorkerConcurrency = cfg.WorkerConcurrency
+	next.PrefetchCount = cfg.PrefetchCount
+	next.MaxRetries = cfg.MaxRetries
+	next.RetryJitter = cfg.RetryJitter
+	next.ThrottleMaxPause = cfg.ThrottleMaxPause
+	next.BreakerMinRequests = cfg.BreakerMinRequests
+	next.BreakerFailureRatio = cfg.BreakerFailureRatio
+	next.DisabledProviders = cfg.DisabledProviders
+	next.LogLevel = cfg.LogLevel
+
+	err := w.checkRetryQueues(cfg)
+	if err == nil {
+		next.RetryDelays = cfg.RetryDelays
+	} else {
+		err = &NotReloadedError{Setting: "RETRY_DELAYS", Err: fmt.Errorf("keeping %v: %w", next.RetryDelays, err)}
+	}
+
+	w.Throttle.SetMaxPause(next.ThrottleMaxPause)
+	w.live.Store(&next)
+	return err
+}
+
+// NotReloadedError reports a setting Reconfigure kept at its running value while it applied the
+// others. Setting is the setting's environment variable name.
+type NotReloadedError struct {
+	Setting string
+	Err     error
+}
+
+func (e *NotReloadedError) Error() string {
+	return fmt.Sprintf("%s not reloaded, %v", e.Setting, e.Err)
+}
+func (e *NotReloadedError) Unwrap() error { return e.Err }
+
+// checkRetryQueues reports the first delay of cfg's schedule that has no retry queue.
+func (w *PushWorker) checkRetryQueues(cfg Config) error {
+	declared := w.Config.RetryQueues()
+	for _, q := range cfg.RetryQueues() {
+		if !slices.Contains(declared, q) {
+			return fmt.Errorf("retry delay %s has no queue (%s); new retry tiers are only declared at startup", q.Delay, q.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+func TestReconfigureChangesRetriesLive(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	cfg := tw.Settings()
+	cfg.MaxRetries = 8
+	cfg.RetryDelays = []time.Duration{30 * time.Second, 2 * time.Minute}
+	cfg.ThrottleMaxPause = time.Second
+	if err := tw.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the old limit of 5, but the new limit allows another retry, in the new first tier.
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome", RetryCount: 5})
+	if ack.get() != "ack" || len(tw.pub.deadLettered()) != 0 {
+		t.Fatalf("outcome %q with %d DLQ copies, want a retry", ack.get(), len(tw.pub.deadLettered()))
+	}
+	if n := len(tw.pub.byKey("push.queue.retry.2m")); n != 1 {
+		t.Errorf("%d retries in the 2m tier, want 1", n)
+	}
+	if tw.Config.MaxRetries != 5 {
+		t.Errorf("Config.MaxRetries = %d, want the startup value kept", tw.Config.MaxRetries)
+	}
+	if got := time.Duration(tw.Throttle.maxPause.Load()); got != time.Second {
+		t.Errorf("throttle max pause = %s, want 1s", got)
+	}
+}
+
+func TestReconfigureKeepsRetryDelaysWithUndeclaredTier(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices("tok-1"))
+
+	cfg := tw.Settings()
+	cfg.MaxRetries = 8
+	cfg.RetryDelays = []time.Duration{5 * time.Second, 45 * time.Second}
+	cfg.DisabledProviders = []string{"apns"}
+	err := tw.Reconfigure(cfg)
+	var kept *NotReloadedError
+	if !errors.As(err, &kept) || kept.Setting != "RETRY_DELAYS" || !strings.Contains(err.Error(), "push.queue.retry.45s") {
+		t.Fatalf("err = %v, want RETRY_DELAYS kept for the missing 45s tier", err)
+	}
+	s := tw.Settings()
+	if !slices.Equal(s.RetryDelays, DefaultRetryDelays) {
+		t.Errorf("RetryDelays = %v, want the running schedule kept", s.RetryDelays)
+	}
+	if s.MaxRetries != 8 || !slices.Equal(s.DisabledProviders, []string{"apns"}) {
+		t.Errorf("MaxRetries = %d, DisabledProviders = %v; want the other settings applied", s.MaxRetries, s.DisabledProviders)
+	}
+}
+
+func TestDisabledProviderHoldsDevicesBack(t *testing.T) {
+	sent := 0
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		sent++
+		return "id", nil
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	cfg := tw.Settings()
+	cfg.DisabledProviders = []string{"fcm"}
+	if err := tw.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if sent != 0 {
+		t.Errorf("%d sends through a disabled provider", sent)
+	}
+	if n := len(tw.pub.byKey("push.queue.retry.5s")); n != 1 {
+		t.Errorf("%d retries, want the job retried until the provider is back", n)
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetryDelays is the backoff schedule used when RETRY_DELAYS is not set.
+var DefaultRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute, time.Hour}
+
+// RetryQueue is one tier of the retry schedule: a queue without consumers whose messages
+// expire after Delay and are dead-lettered back onto the main push queue.
+type RetryQueue struct {
+	Name  string
+	Delay time.Duration
+}
+
+// RetryQueues returns the delay queues for the configured schedule, shortest first.
+func (c Config) RetryQueues() []RetryQueue {
+	queues := make([]RetryQueue, len(c.RetryDelays))
+	for i, d := range c.RetryDelays {
+		queues[i] = RetryQueue{Name: c.QueueName + ".retry." + shortDuration(d), Delay: d}
+	}
+	return queues
+}
+
+// retryQueueFor picks the tier for a job that has already been retried retryCount times.
+// When a provider asked for a back-off of minDelay, tiers shorter than that are skipped.
+// Jobs past the end of the schedule keep using the longest delay.
+func (c Config) retryQueueFor(retryCount int, minDelay time.Duration) RetryQueue {
+	queues := c.RetryQueues()
+	i := min(max(retryCount, 0), len(queues)-1)
+	for i < len(queues)-1 && queues[i].Delay < minDelay {
+		i++
+	}
+	return queues[i]
+}
+
+// jitteredDelay shortens delay by a random fraction of up to jitter, so jobs that failed together
+// do not all come back at the same moment. It never exceeds delay: the queue TTL is the ceiling.
+// r is a uniform sample in [0, 1).
+func jitteredDelay(delay time.Duration, jitter, r float64) time.Duration {
+	if jitter <= 0 {
+		return delay
+	}
+	return delay - time.Duration(float64(delay)*min(jitter, 1)*r)
+}
+
+// retryExpiration is the per-message TTL for a retry publish, in the millisecond string form AMQP expects.
+// Jitter never takes it below minDelay, the back-off a provider asked for.
+func (c Config) retryExpiration(q RetryQueue, minDelay time.Duration) string {
+	d := max(jitteredDelay(q.Delay, c.RetryJitter, rand.Float64()), min(minDelay, q.Delay))
+	return strconv.FormatInt(max(d.Milliseconds(), 0), 10)
+}
+
+// ParseRetryDelays parses a comma-separated list of durations such as "5s,30s,2m,10m,1h".
+func ParseRetryDelays(value string) ([]time.Duration, error) {
+	var delays []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("retry delay %q must be positive", part)
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) == 0 {
+		return nil, fmt.Errorf("no retry delays in %q", value)
+	}
+	return delays, nil
+}
+
+// shortDuration formats whole hours, minutes or seconds compactly ("2m" rather than "2m0s")
+// so queue names stay readable.
+func shortDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	case d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	default:
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+}
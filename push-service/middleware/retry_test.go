@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetryQueues(t *testing.T) {
+	cfg := Config{QueueName: "push.queue", RetryDelays: DefaultRetryDelays}
+
+	var names []string
+	for _, q := range cfg.RetryQueues() {
+		names = append(names, q.Name)
+	}
+	want := []string{"push.queue.retry.5s", "push.queue.retry.30s", "push.queue.retry.2m", "push.queue.retry.10m", "push.queue.retry.1h"}
+	if !slices.Equal(names, want) {
+		t.Errorf("queue names = %v, want %v", names, want)
+	}
+}
+
+func TestRetryQueueForPicksTierFromRetryCount(t *testing.T) {
+	cfg := Config{QueueName: "push.queue", RetryDelays: DefaultRetryDelays}
+	tests := []struct {
+		retryCount int
+		want       time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 30 * time.Second},
+		{2, 2 * time.Minute},
+		{4, time.Hour},
+		{9, time.Hour}, // Past the schedule: stay on the longest tier.
+		{-1, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := cfg.retryQueueFor(tt.retryCount, 0).Delay; got != tt.want {
+			t.Errorf("retryQueueFor(%d) = %s, want %s", tt.retryCount, got, tt.want)
+		}
+	}
+}
+
+func TestRetryQueueForHonoursRetryAfter(t *testing.T) {
+	cfg := Config{QueueName: "push.queue", RetryDelays: DefaultRetryDelays}
+	tests := []struct {
+		retryCount int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{0, 20 * time.Second, 30 * time.Second},
+		{0, time.Minute, 2 * time.Minute},
+		{3, time.Minute, 10 * time.Minute}, // The tier is already long enough.
+		{0, 3 * time.Hour, time.Hour},      // Capped at the longest tier.
+	}
+	for _, tt := range tests {
+		if got := cfg.retryQueueFor(tt.retryCount, tt.retryAfter).Delay; got != tt.want {
+			t.Errorf("retryQueueFor(%d, %s) = %s, want %s", tt.retryCount, tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestJitteredDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+		r      float64
+		want   time.Duration
+	}{
+		{"no jitter", 0, 0.9, 10 * time.Second},
+		{"no sample", 0.2, 0, 10 * time.Second},
+		{"half of the range", 0.2, 0.5, 9 * time.Second},
+		{"clamped jitter", 5, 0.5, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jitteredDelay(10*time.Second, tt.jitter, tt.r); got != tt.want {
+				t.Errorf("jitteredDelay = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryExpirationStaysWithinTier(t *testing.T) {
+	cfg := Config{RetryJitter: 0.2}
+	q := RetryQueue{Name: "push.queue.retry.30s", Delay: 30 * time.Second}
+	for range 100 {
+		ms, err := strconv.ParseInt(cfg.retryExpiration(q, 0), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms < 24000 || ms > 30000 {
+			t.Fatalf("expiration %dms outside [24000, 30000]", ms)
+		}
+	}
+}
+
+func TestRetryExpirationNeverUndercutsRetryAfter(t *testing.T) {
+	cfg := Config{RetryJitter: 1}
+	q := RetryQueue{Name: "push.queue.retry.2m", Delay: 2 * time.Minute}
+	for range 100 {
+		ms, _ := strconv.ParseInt(cfg.retryExpiration(q, 90*time.Second), 10, 64)
+		if ms < 90000 || ms > 120000 {
+			t.Fatalf("expiration %dms outside [90000, 120000]", ms)
+		}
+	}
+}
+
+func TestParseRetryDelays(t *testing.T) {
+	got, err := ParseRetryDelays(" 1s, 90s ,15m,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{time.Second, 90 * time.Second, 15 * time.Minute}; !slices.Equal(got, want) {
+		t.Errorf("ParseRetryDelays = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "5s,soon", "0s", "-1m"} {
+		if _, err := ParseRetryDelays(bad); err == nil {
+			t.Errorf("ParseRetryDelays(%q) should fail", bad)
+		}
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		5 * time.Second:         "5s",
+		90 * time.Second:        "90s",
+		2 * time.Minute:         "2m",
+		time.Hour:               "1h",
+		1500 * time.Millisecond: "1500ms",
+	}
+	for d, want := range tests {
+		if got := shortDuration(d); got != want {
+			t.Errorf("shortDuration(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
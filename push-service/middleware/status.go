@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// publishStatus reports a lifecycle step of the job to the API Gateway on notifications.status.
+// Like the Email service, a failed publish is logged and never fails the job itself.
+func (w *PushWorker) publishStatus(ctx context.Context, job models.PushNotificationJob, status models.NotificationStatus, cause error, messageIDs []string) {
+	event := models.NotificationStatusEvent{
+		NotificationID: job.NotificationID,
+		Status:         status,
+		Timestamp:      time.Now().UTC(),
+		Service:        models.ServicePush,
+		MessageIDs:     messageIDs,
+	}
+	if event.NotificationID == "" {
+		event.NotificationID = job.RequestID
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+
+	body, _ := json.Marshal(event)
+	err := w.RabbitMQChannel.Publish(w.Config.ExchangeName, w.Config.StatusRoutingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    event.Timestamp,
+		Headers:      injectTrace(ctx, nil), // The gateway can link status updates to the job's trace
+		Body:         body,
+	})
+	if err != nil {
+		w.log(job).Warn("Failed to publish status event.", "status", status, "notification_id", event.NotificationID, log.Err(err))
+	}
+}
+
+// deliveredMessageIDs collects the provider message IDs of the devices reached on this attempt.
+func deliveredMessageIDs(outcome deliveryOutcome) []string {
+	var ids []string
+	for _, r := range outcome.Results {
+		if r.Error == "" && !r.Skipped && r.MessageID != "" {
+			ids = append(ids, r.MessageID)
+		}
+	}
+	return ids
+}
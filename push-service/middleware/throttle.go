@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezrahel/log"
+	"github.com/go-redis/redis/v8"
+)
+
+// throttleKey holds the provider that asked every worker to back off; its TTL is the remaining pause.
+const throttleKey = "push:throttle"
+
+// extendPause only replaces the pause when the new one ends later, so a short Retry-After from one
+// provider never cuts a longer quota back-off from another short.
+var extendPause = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Throttle is a consumption pause shared by every worker instance through Redis. When a provider
+// answers with a Retry-After or quota error, the worker pauses consumption everywhere, not only for
+// the job that hit the limit.
+type Throttle struct {
+	rdb      *redis.Client
+	maxPause atomic.Int64 // Caps absurd Retry-After values so a bad header cannot stall the service
+	metrics  *Metrics
+}
+
+// NewThrottle creates the shared throttle; pauses and time spent waiting are counted in m.
+func NewThrottle(rdb *redis.Client, maxPause time.Duration, m *Metrics) *Throttle {
+	t := &Throttle{rdb: rdb, metrics: m}
+	t.SetMaxPause(maxPause)
+	return t
+}
+
+// SetMaxPause changes the longest pause a single Pause call can ask for.
+func (t *Throttle) SetMaxPause(d time.Duration) {
+	t.maxPause.Store(int64(d))
+}
+
+// Pause asks all workers to stop taking new jobs for d. It reports whether this call started or
+// extended the pause.
+func (t *Throttle) Pause(ctx context.Context, source string, d time.Duration) (bool, error) {
+	if maxPause := time.Duration(t.maxPause.Load()); maxPause > 0 {
+		d = min(d, maxPause)
+	}
+	if d < time.Millisecond {
+		return false, nil
+	}
+	extended, err := extendPause.Run(ctx, t.rdb, []string{throttleKey}, source, d.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set global throttle: %w", err)
+	}
+	if extended == 1 {
+		t.metrics.throttlePauses.WithLabelValues(source).Inc()
+	}
+	return extended == 1, nil
+}
+
+// Remaining returns how long the current pause lasts and which provider requested it.
+func (t *Throttle) Remaining(ctx context.Context) (time.Duration, string, error) {
+	pipe := t.rdb.Pipeline()
+	ttl := pipe.PTTL(ctx, throttleKey)
+	source := pipe.Get(ctx, throttleKey)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, "", err
+	}
+	if ttl.Val() <= 0 {
+		return 0, "", nil
+	}
+	return ttl.Val(), source.Val(), nil
+}
+
+// Wait blocks while a pause is active, re-checking when it ends in case it was extended meanwhile.
+// Redis failures never block consumption; they and the pauses are logged to logger.
+func (t *Throttle) Wait(ctx context.Context, logger *slog.Logger) {
+	for {
+		remaining, source, err := t.Remaining(ctx)
+		if err != nil {
+			logger.Warn("Global throttle lookup failed. Not pausing.", log.Err(err))
+			return
+		}
+		if remaining <= 0 {
+			return
+		}
+
+		logger.Info("Global throttle active. Pausing consumption.", "provider", source, "remaining", remaining.Round(time.Millisecond))
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			t.metrics.throttleWaitSeconds.Add(time.Since(start).Seconds())
+			return
+		case <-time.After(remaining):
+			t.metrics.throttleWaitSeconds.Add(time.Since(start).Seconds())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedis(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+func TestThrottlePauseOnlyExtends(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := newTestRedis(t)
+	throttle := NewThrottle(rdb, 5*time.Minute, NewMetrics())
+
+	if extended, err := throttle.Pause(ctx, "fcm", time.Minute); err != nil || !extended {
+		t.Fatalf("first pause: extended=%t err=%v", extended, err)
+	}
+	// A shorter back-off from another provider must not cut the pause short.
+	if extended, _ := throttle.Pause(ctx, "apns", 10*time.Second); extended {
+		t.Error("shorter pause replaced a longer one")
+	}
+
+	remaining, source, err := throttle.Remaining(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "fcm" || remaining < 50*time.Second {
+		t.Errorf("Remaining = %s from %q, want ~1m from fcm", remaining, source)
+	}
+
+	if extended, _ := throttle.Pause(ctx, "onesignal", 2*time.Minute); !extended {
+		t.Error("longer pause did not extend the throttle")
+	}
+	if _, source, _ := throttle.Remaining(ctx); source != "onesignal" {
+		t.Errorf("source = %q, want onesignal", source)
+	}
+}
+
+func TestThrottlePauseIsCapped(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := newTestRedis(t)
+	throttle := NewThrottle(rdb, 30*time.Second, NewMetrics())
+
+	throttle.Pause(ctx, "fcm", 24*time.Hour)
+	if remaining, _, _ := throttle.Remaining(ctx); remaining > 30*time.Second {
+		t.Errorf("Remaining = %s, want at most the 30s cap", remaining)
+	}
+}
+
+func TestThrottleWaitReturnsWhenIdleOrRedisIsDown(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	throttle := NewThrottle(rdb, time.Minute, NewMetrics())
+
+	done := make(chan struct{})
+	go func() {
+		throttle.Wait(context.Background(), slog.Default())
+		mr.Close()
+		throttle.Wait(context.Background(), slog.Default()) // Redis unreachable: must not block consumption.
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked without an active pause")
+	}
+}
+
+func TestThrottleWaitHonoursContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, rdb := newTestRedis(t)
+	throttle := NewThrottle(rdb, time.Minute, NewMetrics())
+	throttle.Pause(context.Background(), "fcm", time.Minute)
+
+	start := time.Now()
+	throttle.Wait(ctx, slog.Default())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait took %s after the context was cancelled", elapsed)
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/ezrahel/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// TokenRegistry remembers device tokens that a provider reported as dead, so the worker stops
+// sending to them (and retrying them) until the User Service has removed them.
+type TokenRegistry struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+// NewTokenRegistry creates a Redis-backed registry. Entries expire after ttl, by which time the
+// User Service is expected to have deleted the token.
+func NewTokenRegistry(rdb *redis.Client, ttl time.Duration) *TokenRegistry {
+	return &TokenRegistry{rdb: rdb, ttl: ttl}
+}
+
+func invalidTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "push:token:invalid:" + hex.EncodeToString(sum[:16])
+}
+
+// IsInvalid reports whether the token has been marked invalid.
+func (r *TokenRegistry) IsInvalid(ctx context.Context, token string) (bool, error) {
+	n, err := r.rdb.Exists(ctx, invalidTokenKey(token)).Result()
+	return n > 0, err
+}
+
+// MarkInvalid records the token as dead. It returns false if the token was already marked,
+// so callers only publish one invalidation event per token.
+func (r *TokenRegistry) MarkInvalid(ctx context.Context, event models.TokenInvalidatedEvent) (bool, error) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	return r.rdb.SetNX(ctx, invalidTokenKey(event.Token), value, r.ttl).Result()
+}
+
+// Forget removes the token from the registry, for a token whose invalidation could not be reported.
+func (r *TokenRegistry) Forget(ctx context.Context, token string) error {
+	return r.rdb.Del(ctx, invalidTokenKey(token)).Err()
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ezrahel/models"
+)
+
+var errUnregistered = errors.New("registration token not registered")
+
+// deadTokenProvider reports tok-dead as unregistered and delivers to every other device.
+func deadTokenProvider() (*fakeProvider, *[]string) {
+	var sent []string
+	return &fakeProvider{
+		name: "fcm",
+		send: func(msg models.PushMessage) (string, error) {
+			sent = append(sent, msg.Token)
+			if msg.Token == "tok-dead" {
+				return "", models.Permanent(errUnregistered)
+			}
+			return "msg-" + msg.Token, nil
+		},
+		invalid: func(err error) bool { return errors.Is(err, errUnregistered) },
+	}, &sent
+}
+
+func (tw *testWorker) invalidations(t *testing.T) []models.TokenInvalidatedEvent {
+	t.Helper()
+	var events []models.TokenInvalidatedEvent
+	for _, body := range tw.pub.byKey("push.token.invalidated") {
+		var e models.TokenInvalidatedEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatalf("bad token invalidation event %s: %v", body, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestDeadTokenIsRecordedAndReportedOnce(t *testing.T) {
+	provider, _ := deadTokenProvider()
+	tw := newTestWorker(t, provider, userWithDevices("tok-1", "tok-dead"))
+
+	ack := tw.process(t, models.PushNotificationJob{NotificationID: "n-1", RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+	if got := statusList(tw.pub.statuses(t)); got != "pending,delivered" {
+		t.Errorf("statuses = %s, want pending,delivered: the other device was reached", got)
+	}
+
+	events := tw.invalidations(t)
+	if len(events) != 1 {
+		t.Fatalf("%d token invalidation events, want 1", len(events))
+	}
+	e := events[0]
+	if e.UserID != "u-1" || e.Token != "tok-dead" || e.Platform != models.PlatformAndroid || e.Provider != "fcm" || e.RequestID != "r-1" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if !strings.Contains(e.Reason, errUnregistered.Error()) || e.Timestamp.IsZero() {
+		t.Errorf("event reason %q, timestamp %s", e.Reason, e.Timestamp)
+	}
+
+	stored, err := tw.redis.Get(invalidTokenKey("tok-dead"))
+	if err != nil {
+		t.Fatalf("token registry entry: %v", err)
+	}
+	var recorded models.TokenInvalidatedEvent
+	if err := json.Unmarshal([]byte(stored), &recorded); err != nil || recorded.Token != "tok-dead" || recorded.RequestID != "r-1" {
+		t.Errorf("registry entry = %s (%v), want the event", stored, err)
+	}
+	if ttl := tw.redis.TTL(invalidTokenKey("tok-dead")); ttl != tw.Config.InvalidTokenTTL {
+		t.Errorf("registry entry TTL = %s, want %s", ttl, tw.Config.InvalidTokenTTL)
+	}
+	if tw.redis.Exists(invalidTokenKey("tok-1")) {
+		t.Error("a delivered token was marked invalid")
+	}
+}
+
+func TestPreviouslyInvalidatedTokenIsSkipped(t *testing.T) {
+	provider, sent := deadTokenProvider()
+	tw := newTestWorker(t, provider, userWithDevices("tok-1", "tok-dead"))
+	tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+
+	*sent = nil
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-2", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+	if got := strings.Join(*sent, ","); got != "tok-1" {
+		t.Errorf("sent to %s, want only tok-1", got)
+	}
+	if n := len(tw.invalidations(t)); n != 1 {
+		t.Errorf("%d token invalidation events, want only the first job's", n)
+	}
+
+	// A user whose only device is dead has nothing left to deliver; the job is not retried.
+	only := newTestWorker(t, provider, userWithDevices("tok-dead"))
+	if _, err := only.TokenRegistry.MarkInvalid(context.Background(), models.TokenInvalidatedEvent{Token: "tok-dead"}); err != nil {
+		t.Fatal(err)
+	}
+	*sent = nil
+	ack = only.process(t, models.PushNotificationJob{RequestID: "r-3", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" || len(*sent) != 0 || len(only.pub.byKey("push.queue.retry.5s")) != 0 {
+		t.Errorf("outcome %q after %d sends and %d retries, want the job dropped unsent", ack.get(), len(*sent), len(only.pub.byKey("push.queue.retry.5s")))
+	}
+	if n := len(only.invalidations(t)); n != 0 {
+		t.Errorf("%d token invalidation events for a token already reported", n)
+	}
+}
+
+func TestTokenReportedByAnotherWorkerIsNotPublishedAgain(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices())
+	ctx := context.Background()
+
+	// Another worker marked the token between our send and the prune.
+	fresh, err := tw.TokenRegistry.MarkInvalid(ctx, models.TokenInvalidatedEvent{Token: "tok-dead", RequestID: "r-other"})
+	if err != nil || !fresh {
+		t.Fatalf("MarkInvalid = %t, %v", fresh, err)
+	}
+
+	job := models.PushNotificationJob{RequestID: "r-1", UserID: "u-1"}
+	user := models.UserData{Devices: []models.Device{{Token: "tok-dead", Platform: models.PlatformAndroid}}}
+	outcome := deliveryOutcome{Results: []models.DeviceResult{{
+		Token: "tok-dead", Provider: "fcm", Class: models.ErrorClassPermanent, Error: "unregistered", TokenInvalid: true,
+	}}}
+	tw.pruneInvalidTokens(ctx, job, user, outcome)
+
+	if n := len(tw.invalidations(t)); n != 0 {
+		t.Errorf("%d token invalidation events, want none", n)
+	}
+	stored, _ := tw.redis.Get(invalidTokenKey("tok-dead"))
+	if !strings.Contains(stored, "r-other") {
+		t.Errorf("registry entry = %s, want the first report kept", stored)
+	}
+}
+
+func TestUnpublishedInvalidationIsReportedOnNextAttempt(t *testing.T) {
+	tw := newTestWorker(t, &fakeProvider{name: "fcm"}, userWithDevices())
+	ctx := context.Background()
+
+	job := models.PushNotificationJob{RequestID: "r-1", UserID: "u-1"}
+	user := models.UserData{Devices: []models.Device{{Token: "tok-dead", Platform: models.PlatformAndroid}}}
+	outcome := deliveryOutcome{Results: []models.DeviceResult{{
+		Token: "tok-dead", Provider: "fcm", Class: models.ErrorClassPermanent, Error: "unregistered", TokenInvalid: true,
+	}}}
+
+	tw.pub.err = errors.New("channel closed")
+	tw.pruneInvalidTokens(ctx, job, user, outcome)
+	if tw.redis.Exists(invalidTokenKey("tok-dead")) {
+		t.Error("token left in the registry although its invalidation was not published")
+	}
+
+	tw.pub.err = nil
+	tw.pruneInvalidTokens(ctx, job, user, outcome)
+	if n := len(tw.invalidations(t)); n != 1 {
+		t.Errorf("%d token invalidation events on the next attempt, want 1", n)
+	}
+	if !tw.redis.Exists(invalidTokenKey("tok-dead")) {
+		t.Error("token not in the registry after it was reported")
+	}
+}
@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// FailedQueue is the permanent Dead Letter Queue. Jobs rejected from push.queue reach it through
+// the dead-letter exchange (Config.DLXName).
+const FailedQueue = "failed.queue"
+
+// Topology modes (TOPOLOGY_MODE).
+const (
+	TopologyDeclare = "declare" // Create anything missing; fail if something exists with other settings
+	TopologyVerify  = "verify"  // Only check the broker; for production, where topology is provisioned separately
+)
+
+// ErrTopologyMismatch means the broker has an exchange or queue missing or declared with other
+// settings than the spec. Reconnecting does not fix it, so the worker stops instead.
+var ErrTopologyMismatch = errors.New("broker topology does not match the spec")
+
+// ExchangeSpec is a durable exchange.
+type ExchangeSpec struct {
+	Name string
+	Kind string // direct, fanout, topic
+}
+
+// QueueSpec is a durable queue with its x-arguments.
+type QueueSpec struct {
+	Name string
+	Args amqp.Table
+}
+
+// BindingSpec routes Key on Exchange to Queue.
+type BindingSpec struct {
+	Queue    string
+	Exchange string
+	Key      string
+}
+
+// Topology is every exchange, queue and binding the push service relies on, in declaration order.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+}
+
+// Topology builds the spec for this configuration.
+func (c Config) Topology() Topology {
+	t := Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: c.ExchangeName, Kind: amqp.ExchangeDirect},
+			// Fanout, so dead-lettered jobs reach failed.queue whatever routing key they carried.
+			{Name: c.DLXName, Kind: amqp.ExchangeFanout},
+		},
+		Queues: []QueueSpec{
+			{Name: FailedQueue},
+			// Rejected jobs go to the DLX and from there to failed.queue.
+			{Name: c.QueueName, Args: amqp.Table{"x-dead-letter-exchange": c.DLXName}},
+			// push.token.invalidated events for the User Service, kept even before it consumes them.
+			{Name: c.TokenInvalidatedRoutingKey},
+		},
+		Bindings: []BindingSpec{
+			{Queue: FailedQueue, Exchange: c.DLXName},
+			{Queue: FailedQueue, Exchange: c.ExchangeName, Key: "failed"},
+			{Queue: c.QueueName, Exchange: c.ExchangeName, Key: c.QueueName},
+			{Queue: c.TokenInvalidatedRoutingKey, Exchange: c.ExchangeName, Key: c.TokenInvalidatedRoutingKey},
+		},
+	}
+
+	// The retry delay queues (push.queue.retry.5s, ...). Failed jobs wait in the tier for their retry
+	// count; the queue TTL is the tier delay, after which they are dead-lettered back to push.queue.
+	for _, q := range c.RetryQueues() {
+		t.Queues = append(t.Queues, QueueSpec{Name: q.Name, Args: amqp.Table{
+			"x-message-ttl":             q.Delay.Milliseconds(),
+			"x-dead-letter-exchange":    c.ExchangeName,
+			"x-dead-letter-routing-key": c.QueueName,
+		}})
+		t.Bindings = append(t.Bindings, BindingSpec{Queue: q.Name, Exchange: c.ExchangeName, Key: q.Name})
+	}
+	return t
+}
+
+// topologyChannel is the part of *amqp.Channel used to declare and verify the topology.
+type topologyChannel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Close() error
+}
+
+// Declare creates the topology. Declarations are idempotent, so it runs on every (re)connect.
+// An entity that exists with other settings fails with ErrTopologyMismatch.
+func (t Topology) Declare(ch topologyChannel) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.Kind, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", e.Name, mismatch(err))
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args); err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", q.Name, mismatch(err))
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind %s to %s (%q): %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
+
+// Verify checks that every exchange and queue exists with the spec's settings, without creating
+// anything, and reports all differences at once. A passive declare proves existence; the following
+// regular declare is then a no-op that the broker refuses if the settings differ.
+// AMQP has no way to read bindings, so they are not checked.
+//
+// A failed check closes the channel, so open is called for a fresh one after each failure.
+func (t Topology) Verify(open func() (topologyChannel, error)) error {
+	ch, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+
+	var errs []error
+	check := func(what string, f func(ch topologyChannel) error) error {
+		if err := f(ch); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", what, mismatch(err)))
+			if ch, err = open(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, e := range t.Exchanges {
+		err := check("exchange "+e.Name, func(ch topologyChannel) error {
+			if err := ch.ExchangeDeclarePassive(e.Name, e.Kind, true, false, false, false, nil); err != nil {
+				return err
+			}
+			return ch.ExchangeDeclare(e.Name, e.Kind, true, false, false, false, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, q := range t.Queues {
+		err := check("queue "+q.Name, func(ch topologyChannel) error {
+			if _, err := ch.QueueDeclarePassive(q.Name, true, false, false, false, q.Args); err != nil {
+				return err
+			}
+			_, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mismatch marks the broker's "not found" and "precondition failed" answers as ErrTopologyMismatch.
+// Anything else, like a dropped connection, is returned as is and worth retrying.
+func mismatch(err error) error {
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && (amqpErr.Code == amqp.NotFound || amqpErr.Code == amqp.PreconditionFailed) {
+		return fmt.Errorf("%w: %s", ErrTopologyMismatch, amqpErr.Reason)
+	}
+	return err
+}
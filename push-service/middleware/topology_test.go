@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker holds exchanges and queues like RabbitMQ and answers declarations the same way:
+// missing entities are 404 for passive declares, differing settings are 406.
+type fakeBroker struct {
+	exchanges map[string]string
+	queues    map[string]amqp.Table
+	bindings  []BindingSpec
+	opened    int
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{exchanges: map[string]string{}, queues: map[string]amqp.Table{}}
+}
+
+func (b *fakeBroker) open() (topologyChannel, error) {
+	b.opened++
+	return &fakeTopologyChannel{broker: b}, nil
+}
+
+type fakeTopologyChannel struct {
+	broker *fakeBroker
+	closed bool
+}
+
+func (c *fakeTopologyChannel) fail(code int, format string, args ...any) error {
+	c.closed = true // Like RabbitMQ, a channel error closes the channel.
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (c *fakeTopologyChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if existing, ok := c.broker.exchanges[name]; ok && existing != kind {
+		return c.fail(amqp.PreconditionFailed, "inequivalent arg 'type' for exchange '%s'", name)
+	}
+	c.broker.exchanges[name] = kind
+	return nil
+}
+
+func (c *fakeTopologyChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if _, ok := c.broker.exchanges[name]; !ok {
+		return c.fail(amqp.NotFound, "no exchange '%s'", name)
+	}
+	return nil
+}
+
+func (c *fakeTopologyChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if c.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if existing, ok := c.broker.queues[name]; ok && !reflect.DeepEqual(existing, args) {
+		return amqp.Queue{}, c.fail(amqp.PreconditionFailed, "inequivalent args for queue '%s'", name)
+	}
+	c.broker.queues[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeTopologyChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if _, ok := c.broker.queues[name]; !ok {
+		return amqp.Queue{}, c.fail(amqp.NotFound, "no queue '%s'", name)
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeTopologyChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.broker.bindings = append(c.broker.bindings, BindingSpec{Queue: name, Exchange: exchange, Key: key})
+	return nil
+}
+
+func (c *fakeTopologyChannel) Close() error { return nil }
+
+func topologyConfig() Config {
+	return Config{
+		QueueName:                  "push.queue",
+		DLXName:                    "notifications.dlx",
+		ExchangeName:               "notifications.direct",
+		TokenInvalidatedRoutingKey: "push.token.invalidated",
+		RetryDelays:                DefaultRetryDelays,
+	}
+}
+
+func TestTopologyDeadLettersToFailedQueue(t *testing.T) {
+	topo := topologyConfig().Topology()
+
+	exchanges := map[string]bool{}
+	for _, e := range topo.Exchanges {
+		exchanges[e.Name] = true
+	}
+	queues := map[string]bool{}
+	for _, q := range topo.Queues {
+		queues[q.Name] = true
+		// Every dead-letter target must be declared, or RabbitMQ silently drops the message.
+		if dlx, ok := q.Args["x-dead-letter-exchange"].(string); ok && !exchanges[dlx] {
+			t.Errorf("queue %s dead-letters to undeclared exchange %s", q.Name, dlx)
+		}
+	}
+	for _, b := range topo.Bindings {
+		if !exchanges[b.Exchange] || !queues[b.Queue] {
+			t.Errorf("binding %+v refers to an undeclared exchange or queue", b)
+		}
+	}
+
+	var dlqBound bool
+	for _, b := range topo.Bindings {
+		dlqBound = dlqBound || (b.Exchange == "notifications.dlx" && b.Queue == FailedQueue)
+	}
+	if !dlqBound {
+		t.Error("failed.queue is not bound to the dead-letter exchange")
+	}
+}
+
+func TestTopologyDeclare(t *testing.T) {
+	broker := newFakeBroker()
+	ch, _ := broker.open()
+	topo := topologyConfig().Topology()
+
+	if err := topo.Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+	if len(broker.queues) != len(topo.Queues) || len(broker.bindings) != len(topo.Bindings) {
+		t.Errorf("declared %d queues and %d bindings, want %d and %d", len(broker.queues), len(broker.bindings), len(topo.Queues), len(topo.Bindings))
+	}
+	// Redeclaring on reconnect is a no-op.
+	ch, _ = broker.open()
+	if err := topo.Declare(ch); err != nil {
+		t.Errorf("redeclare: %v", err)
+	}
+}
+
+func TestTopologyDeclareReportsMismatch(t *testing.T) {
+	broker := newFakeBroker()
+	broker.queues["push.queue"] = nil // Declared elsewhere without the DLX argument.
+	ch, _ := broker.open()
+
+	err := topologyConfig().Topology().Declare(ch)
+	if !errors.Is(err, ErrTopologyMismatch) || !strings.Contains(err.Error(), "push.queue") {
+		t.Errorf("err = %v, want ErrTopologyMismatch for push.queue", err)
+	}
+}
+
+func TestTopologyVerifyDoesNotCreate(t *testing.T) {
+	broker := newFakeBroker()
+	topo := topologyConfig().Topology()
+	ch, _ := broker.open()
+	topo.Declare(ch)
+	delete(broker.queues, FailedQueue)
+	broker.queues["push.queue"] = nil
+	broker.bindings = nil
+
+	err := topo.Verify(broker.open)
+	if !errors.Is(err, ErrTopologyMismatch) {
+		t.Fatalf("err = %v, want ErrTopologyMismatch", err)
+	}
+	// Both problems are reported, each on a fresh channel.
+	for _, want := range []string{"queue failed.queue", "queue push.queue"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, missing %q", err, want)
+		}
+	}
+	if _, ok := broker.queues[FailedQueue]; ok {
+		t.Error("verify created failed.queue")
+	}
+	if len(broker.bindings) != 0 {
+		t.Error("verify created bindings")
+	}
+	if broker.opened != 4 {
+		t.Errorf("opened %d channels, want 4", broker.opened)
+	}
+
+	// A matching broker passes.
+	broker = newFakeBroker()
+	ch, _ = broker.open()
+	topo.Declare(ch)
+	if err := topo.Verify(broker.open); err != nil {
+		t.Errorf("verify of a declared topology: %v", err)
+	}
+}
+
+func TestMismatchKeepsConnectionErrorsRetryable(t *testing.T) {
+	if errors.Is(mismatch(amqp.ErrClosed), ErrTopologyMismatch) {
+		t.Error("a closed connection was treated as a topology mismatch")
+	}
+}
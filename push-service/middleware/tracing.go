@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters (TRACING_EXPORTER).
+const (
+	TracingOff    = "none"
+	TracingOTLP   = "otlp"   // OTLP over HTTP; endpoint and headers come from the standard OTEL_EXPORTER_OTLP_* variables
+	TracingStdout = "stdout" // Spans printed on stdout, for local development
+)
+
+const tracerName = "github.com/ezrahel/middleware"
+
+// propagator reads and writes W3C trace context (traceparent, tracestate) and baggage.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// SetupTracing installs the global tracer provider for cfg.TracingExporter. The returned function
+// flushes buffered spans; call it on shutdown. With tracing off no spans are recorded, but the trace
+// context of incoming jobs is still passed on to the services the worker calls and publishes to.
+func SetupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.TracingExporter {
+	case TracingOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case TracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", cfg.TracingExporter, err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		// Follow the publisher's sampling decision; sample TracingSampleRatio of jobs without one.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("push-service"),
+			semconv.ServiceInstanceID(cfg.InstanceID),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// amqpHeaders lets the propagator read and write AMQP message headers.
+type amqpHeaders amqp.Table
+
+func (h amqpHeaders) Get(key string) string {
+	v, _ := h[key].(string)
+	return v
+}
+
+func (h amqpHeaders) Set(key, value string) { h[key] = value }
+
+func (h amqpHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// extractTrace returns ctx with the trace context the publisher put in the message headers.
+func extractTrace(ctx context.Context, headers amqp.Table) context.Context {
+	return propagator.Extract(ctx, amqpHeaders(headers))
+}
+
+// injectTrace returns a copy of headers with ctx's trace context added, so consumers of the
+// message continue the trace.
+func injectTrace(ctx context.Context, headers amqp.Table) amqp.Table {
+	out := maps.Clone(headers)
+	if out == nil {
+		out = amqp.Table{}
+	}
+	propagator.Inject(ctx, amqpHeaders(out))
+	return out
+}
+
+// TraceHeaders returns the trace context headers of headers (traceparent, tracestate and baggage),
+// or nil when there are none. Republishing a message with only these keeps the copy in the
+// original trace without carrying over the rest of its headers.
+func TraceHeaders(headers amqp.Table) amqp.Table {
+	var out amqp.Table
+	for _, key := range propagator.Fields() {
+		if v, ok := headers[key]; ok {
+			if out == nil {
+				out = amqp.Table{}
+			}
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// endSpan marks the span as failed when err is set, and ends it.
+func endSpan(span trace.Span, err error) {
+	failSpan(span, err)
+	span.End()
+}
+
+// failSpan records err on the span, if set.
+func failSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
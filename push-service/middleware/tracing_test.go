@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	gatewayTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	gatewaySpanID  = "00f067aa0ba902b7"
+)
+
+// traceWorker records the worker's spans and the traceparent the User Service receives.
+func traceWorker(t *testing.T, send func(models.PushMessage) (string, error)) (*testWorker, *tracetest.SpanRecorder, func() string) {
+	t.Helper()
+	var mu sync.Mutex
+	var traceparent string
+	users := userWithDevices("tok-1")
+	tw := newTestWorker(t, &fakeProvider{name: "fcm", send: send}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparent = r.Header.Get("traceparent")
+		mu.Unlock()
+		users(w, r)
+	})
+
+	recorder := tracetest.NewSpanRecorder()
+	tw.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	return tw, recorder, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return traceparent
+	}
+}
+
+func processTraced(tw *testWorker, job models.PushNotificationJob) {
+	body, _ := json.Marshal(job)
+	tw.ProcessMessage(context.Background(), amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{},
+		Headers:      amqp.Table{"traceparent": "00-" + gatewayTraceID + "-" + gatewaySpanID + "-01"},
+		Body:         body,
+	})
+}
+
+func TestProcessMessageContinuesTraceFromHeaders(t *testing.T) {
+	tw, recorder, traceparent := traceWorker(t, func(models.PushMessage) (string, error) { return "id", nil })
+
+	processTraced(tw, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID().String() != gatewayTraceID {
+			t.Errorf("span %s is in trace %s, want the gateway's", s.Name(), s.SpanContext().TraceID())
+		}
+		spans[s.Name()] = s
+	}
+	root, ok := spans["push.process"]
+	if !ok {
+		t.Fatalf("no push.process span among %v", spans)
+	}
+	if root.Parent().SpanID().String() != gatewaySpanID {
+		t.Errorf("push.process parent = %s, want the gateway's span", root.Parent().SpanID())
+	}
+	for _, name := range []string{"push.user_lookup", "push.template_lookup", "push.render", "push.deliver"} {
+		if s, ok := spans[name]; !ok || s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of push.process", name)
+		}
+	}
+	if s, ok := spans["push.provider.send"]; !ok || s.Parent().SpanID() != spans["push.deliver"].SpanContext().SpanID() {
+		t.Error("push.provider.send is not a child of push.deliver")
+	}
+
+	// The lookup and the status events carry the trace on.
+	if got := traceparent(); !strings.Contains(got, gatewayTraceID) {
+		t.Errorf("User Service traceparent = %q, want the job's trace", got)
+	}
+	for _, m := range tw.pub.published {
+		if got, _ := m.Msg.Headers["traceparent"].(string); !strings.Contains(got, gatewayTraceID) {
+			t.Errorf("message to %s has traceparent %q, want the job's trace", m.Key, got)
+		}
+	}
+}
+
+func TestRetryCopyContinuesTrace(t *testing.T) {
+	tw, recorder, _ := traceWorker(t, func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	})
+
+	processTraced(tw, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+
+	var root sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "push.process" {
+			root = s
+		}
+	}
+	if root == nil || root.Status().Code != codes.Error {
+		t.Fatalf("push.process span = %v, want it marked as failed", root)
+	}
+
+	retries := 0
+	for _, m := range tw.pub.published {
+		if m.Key != "push.queue.retry.5s" {
+			continue
+		}
+		retries++
+		want := "00-" + gatewayTraceID + "-" + root.SpanContext().SpanID().String() + "-01"
+		if got := m.Msg.Headers["traceparent"]; got != want {
+			t.Errorf("retry traceparent = %v, want %s (child of this attempt)", got, want)
+		}
+		if m.Msg.Headers[HeaderFailureReason] != FailureDelivery {
+			t.Errorf("retry copy lost its failure headers: %v", m.Msg.Headers)
+		}
+	}
+	if retries != 1 {
+		t.Fatalf("%d retries published, want 1", retries)
+	}
+}
@@ -5,287 +5,496 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"firebase.google.com/go/messaging" 
+	"github.com/ezrahel/log"
+	"github.com/ezrahel/models"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sony/gobreaker"
 	"github.com/streadway/amqp"
-	"github.com/ezrahel/models"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PushWorker holds the dependencies required for processing a push notification job.
 type PushWorker struct {
 	// Clients
-	RabbitMQChannel *amqp.Channel
+	RabbitMQChannel Publisher // *ConfirmPublisher in production
 	RedisClient     *redis.Client
-	FCMClient       *messaging.Client         // Firebase Messaging Client
+	Provider        PushProvider                         // Default push delivery backend
+	Providers       map[string]PushProvider              // All registered backends, keyed by name
+	Breakers        map[string]*gobreaker.CircuitBreaker // One circuit breaker per backend
+	TokenRegistry   *TokenRegistry                       // Dead device tokens reported by providers
+	Idempotency     IdempotencyStore                     // Processing leases and processed/delivered records
+	Throttle        *Throttle                            // Consumption pause shared by all workers
+	Metrics         *Metrics                             // Served on /metrics
 	HTTPClient      *http.Client
-	FCMBreaker      *gobreaker.CircuitBreaker 
-	Config          Config                    
+	Logger          *slog.Logger // Job lines get the job's IDs bound (log.ForJob)
+	Tracer          trace.Tracer // Spans for each stage of ProcessMessage
+	Config          Config       // As started; Settings has the runtime settings as reconfigured since
+
+	live      atomic.Pointer[Config] // Set by Reconfigure
+	storeDown atomic.Bool            // Set by the pause policy when the idempotency store is unreachable
 
 	// Service URLs
-	UserServiceURL    string
+	UserServiceURL     string
 	TemplateServiceURL string
 }
 
 // NewPushWorker initializes the worker with the necessary components and configuration.
-// It now accepts the FCM client.
-func NewPushWorker(ch *amqp.Channel, rdb *redis.Client, fcmClient *messaging.Client, cfg Config) *PushWorker {
-	// Initialize a circuit breaker for the external Push API (FCM/OneSignal).
-	fcmBreaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
-		Name:        "FCMDeliveryBreaker",
-		MaxRequests: 1, 
-		Timeout:     5 * time.Second, 
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			// Trip if 60% of requests failed and we've had at least 10 total requests.
-			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
-			return counts.Requests >= 10 && failureRatio >= 0.6
-		},
-		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-			userData, err := w.fetchUserData(job.UserID)
-			if err != nil { w.handleTransientFailure(ctx, d, &job, fmt.Errorf("user lookup failed: %w", err)); return }
-	})
-
-			if err != nil { w.handleTransientFailure(ctx, d, &job, fmt.Errorf("template lookup failed: %w", err)); return }
-		RabbitMQChannel: ch,
-		RedisClient:     rdb,
-		FCMClient:       fcmClient, // SET FCM CLIENT
-		HTTPClient:      &http.Client{Timeout: 5 * time.Second},
-		FCMBreaker:      fcmBreaker,
-		Config:          cfg,
-		UserServiceURL:    cfg.UserServiceURL,
+// Delivery goes through the given PushProvider, so any backend can be plugged in.
+func NewPushWorker(ch Publisher, rdb *redis.Client, provider PushProvider, cfg Config) *PushWorker {
+	metrics := NewMetrics()
+	// Lookups carry the job's trace context to the User and Template Services.
+	httpClient := &http.Client{
+		Timeout:   cfg.HTTPTimeout,
+		Transport: otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithPropagators(propagator)),
+	}
+	w := &PushWorker{
+		RabbitMQChannel:    ch,
+		RedisClient:        rdb,
+		Provider:           provider,
+		Providers:          map[string]PushProvider{},
+		Breakers:           map[string]*gobreaker.CircuitBreaker{},
+		TokenRegistry:      NewTokenRegistry(rdb, cfg.InvalidTokenTTL),
+		Idempotency:        NewIdempotencyStore(cfg, rdb),
+		Throttle:           NewThrottle(rdb, cfg.ThrottleMaxPause, metrics),
+		Metrics:            metrics,
+		HTTPClient:         httpClient,
+		Logger:             slog.Default(),
+		Tracer:             otel.Tracer(tracerName),
+		Config:             cfg,
+		UserServiceURL:     cfg.UserServiceURL,
 		TemplateServiceURL: cfg.TemplateServiceURL,
 	}
+	w.live.Store(&cfg)
+	w.RegisterProvider(provider)
+	return w
 }
 
 // ProcessMessage is the main logic handler for a single message dequeued from RabbitMQ.
-func (w *PushWorker) ProcessMessage(d amqp.Delivery) {
-	ctx := context.Background()
+// Cancelling ctx aborts the lookups and provider calls; the job is then handed back to RabbitMQ.
+func (w *PushWorker) ProcessMessage(ctx context.Context, d amqp.Delivery) {
 	var job models.PushNotificationJob
+	w.Metrics.jobsConsumed.Inc()
+
+	// Continue the publisher's trace: the API Gateway's, or that of the attempt that scheduled this retry.
+	ctx, span := w.Tracer.Start(extractTrace(ctx, d.Headers), "push.process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(semconv.MessagingSystemRabbitMQ, semconv.MessagingOperationTypeProcess, semconv.MessagingDestinationName(w.Config.QueueName)),
+	)
+	defer span.End()
 
 	if err := json.Unmarshal(d.Body, &job); err != nil {
-		fmt.Printf("Error unmarshaling JSON (Permanent Failure): %v. Rejecting message.\n", err)
-		d.Reject(false) 
+		w.Logger.Error("Invalid job payload (permanent failure). Routing to DLQ failed.queue.", log.Err(err))
+		failSpan(span, err)
+		w.deadLetter(ctx, d, nil, FailureInvalidPayload, models.Permanent(err))
 		return
 	}
+	span.SetAttributes(
+		attribute.String("push.request_id", job.RequestID),
+		attribute.String("push.correlation_id", job.CorrelationID),
+		attribute.String("push.user_id", job.UserID),
+		attribute.Int("push.retry_count", job.RetryCount),
+	)
 
-	fmt.Printf("[%s] Consuming job %s (Retry: %d)\n", job.CorrelationID, job.RequestID, job.RetryCount)
-
-	// --- 1. IDEMPOTENCY CHECK ---
-	if w.isDuplicate(ctx, job.RequestID) { 
-		fmt.Printf("[%s] Job already processed. Acknowledging duplicate.\n", job.CorrelationID)
-		d.Ack(false) 
-		return 
+	logger := w.log(job)
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	logger.Info("Consuming job", "retry", job.RetryCount)
+
+	// --- 1. IDEMPOTENCY CHECK (processing lease) ---
+	l, state, err := w.Idempotency.Acquire(ctx, job.RequestID)
+	if err != nil && ctx.Err() != nil {
+		// Aborted by a shutdown, not a store outage: leave the failure policy out of it.
+		logger.Warn("Job aborted by shutdown. Requeuing.", log.Err(err))
+		d.Nack(false, true)
+		w.Metrics.jobsSkipped.WithLabelValues(skipAborted).Inc()
+		return
+	}
+	if err != nil {
+		if !w.proceedWithoutStore(ctx, d, job, err) {
+			return
+		}
+		state = LeaseAcquired // Fail open: process without a lease
 	}
-	
+	switch state {
+	case LeaseProcessed:
+		logger.Info("Job already processed. Acknowledging duplicate.")
+		d.Ack(false)
+		w.Metrics.jobsSkipped.WithLabelValues(skipDuplicate).Inc()
+		return
+	case LeaseInFlight:
+		// Another worker is on it, or crashed and its lease has not expired yet. Park the copy
+		// instead of acking it, so the job is not lost if that worker never finishes.
+		w.park(ctx, d, job, "is in flight on another worker")
+		w.Metrics.jobsSkipped.WithLabelValues(skipInFlight).Inc()
+		return
+	}
+	defer w.keepLeaseAlive(ctx, l)()
+
 	// --- 2. RETRY CHECK ---
-	if job.RetryCount >= w.Config.MaxRetries { 
-		fmt.Printf("[%s] Max retries reached (%d). Routing to DLQ failed.queue.\n", job.CorrelationID, job.RetryCount)
-		d.Reject(false) 
-		return 
+	if job.RetryCount >= w.Settings().MaxRetries {
+		logger.Error("Max retries reached. Routing to DLQ failed.queue.", "retry", job.RetryCount)
+		err := fmt.Errorf("max retries reached (%d)", job.RetryCount)
+		failSpan(span, err)
+		w.releaseLease(ctx, l)
+		w.publishStatus(ctx, job, models.StatusFailed, err, nil)
+		// The retry copy carries the last attempt's error; keep it rather than "max retries".
+		w.deadLetter(ctx, d, &job, FailureMaxRetries, nil)
+		return
 	}
 
+	w.publishStatus(ctx, job, models.StatusPending, nil, nil)
+
 	// --- 3. SYNCHRONOUS LOOKUPS ---
-	userData, err := w.fetchUserData(job.UserID)
-	if err != nil { w.handleTransientFailure(d, &job, fmt.Errorf("user lookup failed: %w", err)); return }
-	templateData, err := w.fetchTemplateData(job.TemplateID)
-	if err != nil { w.handleTransientFailure(d, &job, fmt.Errorf("template lookup failed: %w", err)); return }
+	stageCtx, done := w.stage(ctx, "push.user_lookup", w.Metrics.userLookupSeconds)
+	userData, err := w.fetchUserData(stageCtx, job.UserID)
+	done(err)
+	if err != nil {
+		w.handleFailure(ctx, d, &job, l, FailureUserLookup, fmt.Errorf("user lookup failed: %w", err))
+		return
+	}
+	stageCtx, done = w.stage(ctx, "push.template_lookup", w.Metrics.templateLookupSeconds)
+	templateData, err := w.fetchTemplateData(stageCtx, job.TemplateID)
+	done(err)
+	if err != nil {
+		w.handleFailure(ctx, d, &job, l, FailureTemplateLookup, fmt.Errorf("template lookup failed: %w", err))
+		return
+	}
 
 	// --- 4. TEMPLATE RENDERING ---
+	_, done = w.stage(ctx, "push.render", w.Metrics.renderSeconds)
 	renderedTitle, renderedBody, err := w.renderTemplate(templateData, job.Variables)
-	if err != nil { 
-		fmt.Printf("[%s] Failed to render template (Permanent Failure): %v. Rejecting.\n", job.CorrelationID, err)
-		d.Reject(false) 
+	done(err)
+	if err != nil {
+		w.handleFailure(ctx, d, &job, l, FailureRender, models.Permanent(fmt.Errorf("failed to render template: %w", err)))
 		return
 	}
 
-	// --- 5. EXECUTE DELIVERY (Wrapped in Circuit Breaker) ---
-	_,deliveryErr := w.FCMBreaker.Execute(func() (interface{}, error) {
-		return nil, w.sendFCMNotification(ctx, userData.PushToken, renderedTitle, renderedBody, templateData.LinkURL)
+	// --- 5. EXECUTE DELIVERY (fan-out to every device, each provider behind its own Circuit Breaker) ---
+	stageCtx, deliverSpan := w.Tracer.Start(ctx, "push.deliver")
+	outcome := w.deliverToDevices(stageCtx, job, userData, models.PushMessage{
+		Title:    renderedTitle,
+		Body:     renderedBody,
+		LinkURL:  templateData.LinkURL,
+		ImageURL: templateData.Image,
 	})
+	deliverSpan.SetAttributes(attribute.Int("push.devices", len(outcome.Results)), attribute.Int("push.delivered", outcome.Delivered))
+	endSpan(deliverSpan, outcome.Err())
+	for _, r := range outcome.Results {
+		switch {
+		case r.Skipped:
+			logger.Info("Device already received this notification. Skipping.", "device", maskToken(r.Token), "provider", r.Provider)
+		case r.Error == "":
+			logger.Info("Message sent", "device", maskToken(r.Token), "provider", r.Provider, "message_id", r.MessageID)
+		default:
+			logger.Warn("Delivery failed", "device", maskToken(r.Token), "provider", r.Provider, "class", r.Class, "error", r.Error)
+		}
+	}
+	w.pruneInvalidTokens(ctx, job, userData, outcome)
+
+	if outcome.RetryAfter > 0 {
+		w.backOff(ctx, job, outcome.BackoffProvider, outcome.RetryAfter)
+	}
 
-	if deliveryErr != nil {
-		w.handleTransientFailure(ctx, d, &job, fmt.Errorf("push delivery failed (CB state: %s): %w", w.FCMBreaker.State().String(), deliveryErr))
+	if outcome.Transient > 0 || outcome.Delivered == 0 {
+		// On retry only the devices that have not succeeded yet are resent.
+		w.handleFailure(ctx, d, &job, l, FailureDelivery, outcome.Err())
 		return
 	}
 
 	// --- 6. SUCCESS ---
+	// Devices that failed permanently (dead tokens) are reported alongside the delivered status.
 	w.markAsProcessed(ctx, job.RequestID)
+	w.publishStatus(ctx, job, models.StatusDelivered, outcome.Err(), deliveredMessageIDs(outcome))
 	d.Ack(false)
-	fmt.Printf("[%s] Successfully processed notification for user %s.\n", job.CorrelationID, job.UserID)
+	w.Metrics.jobsSucceeded.Inc()
+	logger.Info("Successfully processed notification", "delivered", outcome.Delivered, "devices", len(outcome.Results))
 }
 
-
-// sendFCMNotification is the **REAL** implementation using the Firebase Admin SDK.
-func (w *PushWorker) sendFCMNotification(ctx context.Context, token, title, body, link string) error {
-	
-	// Create the FCM message payload
-	message := &messaging.Message{
-		Notification: &messaging.Notification{
-			Title: title,
-			Body:  body,
-		},
-		Data: map[string]string{
-			"link_url": link, // Send link as data for custom app handling
-		},
-		Token: token, // Target the specific device token
+// backOff records a provider's Retry-After and pauses consumption on every worker for that long.
+func (w *PushWorker) backOff(ctx context.Context, job models.PushNotificationJob, provider string, d time.Duration) {
+	w.Metrics.retryAfterJobs.WithLabelValues(provider).Inc()
+	w.Metrics.retryAfterSeconds.WithLabelValues(provider).Add(d.Seconds())
+
+	extended, err := w.Throttle.Pause(ctx, provider, d)
+	switch {
+	case err != nil:
+		w.log(job).Warn("Failed to pause consumption", log.Err(err))
+	case extended:
+		w.log(job).Warn("Provider asked us to back off. Throttling consumption on all workers.", "provider", provider, "pause", d)
 	}
+}
 
-	// Send the message using the client
-	response, err := w.FCMClient.Send(ctx, message)
-	
-	if err != nil {
-		// Log the error returned by the FCM API
-		fmt.Printf("FCM Send Error: %v\n", err)
-		return fmt.Errorf("fcm send failure: %w", err)
+// handleFailure routes a failed job by its error class: permanent failures go straight to the DLQ,
+// jobs with nothing to deliver are acked and dropped, and everything else is retried.
+// reason is the Failure* step that failed, recorded in the failure headers.
+func (w *PushWorker) handleFailure(ctx context.Context, d amqp.Delivery, job *models.PushNotificationJob, l *Lease, reason string, err error) {
+	logger := w.log(*job)
+	failSpan(trace.SpanFromContext(ctx), err)
+	if ctx.Err() != nil {
+		// Aborted by a shutdown that ran out of time, not a real failure: don't count a retry.
+		logger.Warn("Job aborted by shutdown. Requeuing.", log.Err(err))
+		w.releaseLease(ctx, l)
+		d.Nack(false, true)
+		w.Metrics.jobsSkipped.WithLabelValues(skipAborted).Inc()
+		return
+	}
+	switch actionFor(err) {
+	case actionDrop:
+		logger.Info("Nothing to deliver. Acknowledging and dropping.", log.Err(err))
+		w.markAsProcessed(ctx, job.RequestID)
+		w.publishStatus(ctx, *job, models.StatusFailed, err, nil)
+		d.Ack(false)
+		w.Metrics.jobFailed(reason, string(models.ClassOf(err)), providerOf(err), false)
+	case actionDeadLetter:
+		logger.Error("Permanent failure. Routing to DLQ failed.queue.", "failure_reason", reason, log.Err(err))
+		// Release the lease so the job can be replayed from the DLQ once the cause is fixed.
+		w.releaseLease(ctx, l)
+		w.publishStatus(ctx, *job, models.StatusFailed, err, nil)
+		w.deadLetter(ctx, d, job, reason, err)
+	default:
+		w.handleTransientFailure(ctx, d, job, l, reason, err)
 	}
-
-	// Log success and the FCM Message ID
-	fmt.Printf("FCM Message sent successfully: %s\n", response)
-	
-	return nil
 }
 
-// isDuplicate checks Redis using SETNX to enforce idempotency.
-func (w *PushWorker) isDuplicate(ctx context.Context, requestID string) bool {
-	// Use Config TTL
-	ok, err := w.RedisClient.SetNX(ctx, "push:processed:"+requestID, time.Now().Format(time.RFC3339), w.Config.IdempotencyTTL).Result()
-	if err != nil {
-		// Production Change: Log this with a WARN level
-		fmt.Printf("Warning: Redis SETNX failed for %s. Cannot guarantee idempotency: %v\n", requestID, err)
-		return false
+// handleTransientFailure increments the retry count and parks the job in the delay queue for its
+// retry tier. When the tier's TTL expires, RabbitMQ dead-letters it back onto push.queue.
+// It releases the processing lease so the retried message can claim the job again.
+func (w *PushWorker) handleTransientFailure(ctx context.Context, d amqp.Delivery, job *models.PushNotificationJob, l *Lease, reason string, err error) {
+	// A provider's Retry-After sets a floor for the delay, pushing the job to a longer tier if needed.
+	minDelay := models.RetryAfterOf(err)
+	settings := w.Settings()
+	retryQueue := settings.retryQueueFor(job.RetryCount, minDelay)
+
+	logger := w.log(*job)
+	logger.Error("Transient failure. Scheduling a retry.", log.Err(err),
+		"retry", job.RetryCount, "max_retries", settings.MaxRetries, "delay", retryQueue.Delay, "retry_queue", retryQueue.Name)
+	if minDelay > 0 {
+		logger.Info("Retry delayed as requested by the provider.", "min_delay", min(minDelay, retryQueue.Delay))
 	}
-	return !ok 
-}
 
-// markAsProcessed ensures the key is properly set upon success.
-func (w *PushWorker) markAsProcessed(ctx context.Context, requestID string) {
-	w.RedisClient.Set(ctx, "push:processed:"+requestID, time.Now().Format(time.RFC3339), w.Config.IdempotencyTTL)
-}
+	retry := *job
+	retry.RetryCount++
 
-// handleTransientFailure increments retry count and rejects the message for DLQ routing.
-// It now accepts a context so it can cleanup the idempotency key in Redis when re-queuing.
-func (w *PushWorker) handleTransientFailure(ctx context.Context, d amqp.Delivery, job *models.PushNotificationJob, err error) {
-	// Production Change: Log this with an ERROR level, including correlation ID
-	fmt.Printf("[%s] Transient failure (Retry %d/%d): %v. Re-queuing via DLX.\n", job.CorrelationID, job.RetryCount, w.Config.MaxRetries, err)
-
-	job.RetryCount++
-	
-	// In the current simple DLX setup, we re-publish with the updated body 
-	// before rejecting, which provides more control over the message content.
-	
-	newBody, marshalErr := json.Marshal(job)
+	// We re-publish the updated body instead of rejecting, so the retry count travels with the job.
+	newBody, marshalErr := json.Marshal(retry)
 	if marshalErr != nil {
-		fmt.Printf("CRITICAL: Failed to re-marshal job for retry, losing progress: %v\n", marshalErr)
-		d.Reject(false) // Reject permanently to failed queue
+		logger.Error("Failed to re-marshal job for retry. Routing to DLQ failed.queue.", log.Err(marshalErr))
+		w.releaseLease(ctx, l)
+		w.publishStatus(ctx, *job, models.StatusFailed, err, nil)
+		w.deadLetter(ctx, d, job, FailureRetryPublish, fmt.Errorf("retry could not be scheduled (%v): %w", marshalErr, err))
 		return
 	}
 
-	// Publish the updated job body back to the exchange.
+	// Publish the updated job body to the retry tier's delay queue.
 	publishErr := w.RabbitMQChannel.Publish(
 		w.Config.ExchangeName, // Exchange to publish to
-		w.Config.QueueName,    // Routing key (routes back to push.queue)
+		retryQueue.Name,       // Routing key (routes to the delay queue)
 		false,                 // Mandatory
 		false,                 // Immediate
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        newBody,
-			// Production Change: For exponential backoff, a separate dedicated retry queue
-			// with increasing TTL headers should be used here instead of directly to push.queue.
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent, // Jobs may wait here for up to an hour
+			// The queue TTL is the tier delay; the per-message TTL takes jitter off it.
+			Expiration: settings.retryExpiration(retryQueue, minDelay),
+			// Failure history, so the job's DLQ copy can tell why it ran out of retries.
+			Headers: injectTrace(ctx, w.failureHeaders(d, retry.RetryCount, reason, err)),
+			Body:    newBody,
 		},
 	)
-	
+
 	if publishErr != nil {
-		fmt.Printf("CRITICAL: Failed to re-publish message for retry: %v. Rejecting permanently.\n", publishErr)
-		d.Reject(false)
+		logger.Error("Failed to re-publish job for retry. Routing to DLQ failed.queue.", log.Err(publishErr))
+		w.releaseLease(ctx, l)
+		w.publishStatus(ctx, *job, models.StatusFailed, err, nil)
+		w.deadLetter(ctx, d, job, FailureRetryPublish, fmt.Errorf("retry could not be scheduled (%v): %w", publishErr, err))
 		return
 	}
-	
+
 	// Acknowledge the original delivery since we successfully published the updated copy.
-	// Remove the idempotency key so the retried message can be processed again.
-	if _, delErr := w.RedisClient.Del(ctx, "push:processed:"+job.RequestID).Result(); delErr != nil {
-		fmt.Printf("Warning: failed to remove idempotency key for %s: %v\n", job.RequestID, delErr)
+	// Release the lease so the retried message can be processed again.
+	w.releaseLease(ctx, l)
+
+	// Still pending from the gateway's point of view; the error says why it is taking longer.
+	w.publishStatus(ctx, retry, models.StatusPending, fmt.Errorf("retry %d/%d scheduled: %w", retry.RetryCount, settings.MaxRetries, err), nil)
+	d.Ack(false)
+	w.Metrics.jobsRetried.WithLabelValues(reason, string(models.ClassOf(err)), providerOf(err)).Inc()
+}
+
+// proceedWithoutStore applies IdempotencyFailurePolicy after the idempotency store failed.
+// It returns true when the job should be processed anyway; otherwise the delivery has been settled.
+func (w *PushWorker) proceedWithoutStore(ctx context.Context, d amqp.Delivery, job models.PushNotificationJob, err error) bool {
+	switch w.Config.IdempotencyFailurePolicy {
+	case FailClosed:
+		w.park(ctx, d, job, fmt.Sprintf("cannot be checked for duplicates (%v)", err))
+		w.Metrics.jobsSkipped.WithLabelValues(skipStoreUnavailable).Inc()
+		return false
+	case FailPause:
+		w.log(job).Error("Idempotency store unavailable. Requeuing and pausing consumption.", log.Err(err))
+		w.storeDown.Store(true)
+		d.Nack(false, true)
+		w.Metrics.jobsSkipped.WithLabelValues(skipStoreUnavailable).Inc()
+		return false
+	default:
+		// Duplicates are possible until the store is back.
+		w.log(job).Warn("Idempotency store unavailable. Processing without duplicate check.", log.Err(err))
+		return true
 	}
+}
+
+// WaitForIdempotencyStore blocks while the pause policy has stopped consumption, checking every
+// second whether the idempotency store is reachable again. It returns at once in normal operation.
+func (w *PushWorker) WaitForIdempotencyStore(ctx context.Context) {
+	for w.storeDown.Load() {
+		if err := w.Idempotency.Ping(ctx); err == nil {
+			w.Logger.Info("Idempotency store is reachable again. Resuming consumption.")
+			w.storeDown.Store(false)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
 
+// park puts a copy of a job that cannot be processed right now in the shortest retry tier, without
+// counting it as a retry. Used when another worker holds the lease: when the copy comes back, the job
+// is either processed (and acked as a duplicate) or the crashed worker's lease has expired and the job
+// is picked up again. The fail-closed policy also parks jobs while the idempotency store is down.
+func (w *PushWorker) park(ctx context.Context, d amqp.Delivery, job models.PushNotificationJob, reason string) {
+	retryQueue := w.Settings().retryQueueFor(0, 0)
+	w.log(job).Info("Parking job. Checking again later.", "reason", reason, "delay", retryQueue.Delay)
+
+	err := w.RabbitMQChannel.Publish(w.Config.ExchangeName, retryQueue.Name, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Headers:      injectTrace(ctx, d.Headers), // Keep the failure history
+		Body:         d.Body,
+	})
+	if err != nil {
+		// Let RabbitMQ hand it out again rather than lose it.
+		w.log(job).Warn("Failed to park job. Requeuing.", log.Err(err))
+		d.Nack(false, true)
+		return
+	}
 	d.Ack(false)
 }
 
+// log returns the worker's logger with the job's IDs bound.
+func (w *PushWorker) log(job models.PushNotificationJob) *slog.Logger {
+	return log.ForJob(w.Logger, job)
+}
+
+// stage times one step of ProcessMessage in h and in a child span of the job's span.
+// The returned function ends both.
+func (w *PushWorker) stage(ctx context.Context, name string, h prometheus.Observer) (context.Context, func(error)) {
+	ctx, span := w.Tracer.Start(ctx, name)
+	start := time.Now()
+	return ctx, func(err error) {
+		since(h, start)
+		endSpan(span, err)
+	}
+}
+
 // fetchUserData mocks the synchronous REST call to the User Service.
-func (w *PushWorker) fetchUserData(userID string) (models.UserData, error) {
+func (w *PushWorker) fetchUserData(ctx context.Context, userID string) (models.UserData, error) {
 	// Production Note: Use the dedicated HTTP client, potentially wrapped with the circuit breaker
 	// to protect against a User Service failure.
 	url := fmt.Sprintf("%s/%s", w.UserServiceURL, userID)
-	resp, err := w.HTTPClient.Get(url)
+	resp, err := w.get(ctx, url)
 	if err != nil {
-		return models.UserData{}, err
+		// Connection refused, timeout, DNS: the User Service may come back.
+		return models.UserData{}, models.Transient(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return models.UserData{}, fmt.Errorf("user service returned status %d", resp.StatusCode)
+		return models.UserData{}, statusError("user service", resp)
 	}
 
 	var apiResp models.StandardizedResponse
 	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		// Production Change: This is likely a permanent parsing failure.
-		return models.UserData{}, fmt.Errorf("failed to decode user service response: %w", err)
+		return models.UserData{}, models.Permanent(fmt.Errorf("failed to decode user service response: %w", err))
 	}
 
 	if !apiResp.Success || apiResp.Data == nil {
-		return models.UserData{}, fmt.Errorf("user service failed: %s", apiResp.Message)
+		return models.UserData{}, models.Permanent(fmt.Errorf("user service failed: %s", apiResp.Message))
 	}
-	
+
 	dataBytes, _ := json.Marshal(apiResp.Data)
 	var userData models.UserData
 	if err := json.Unmarshal(dataBytes, &userData); err != nil {
-		// Production Change: The payload structure didn't match the expected model. Permanent error.
-		return models.UserData{}, fmt.Errorf("failed to parse user data payload: %w", err)
+		// The payload structure didn't match the expected model.
+		return models.UserData{}, models.Permanent(fmt.Errorf("failed to parse user data payload: %w", err))
 	}
 
-	if userData.PushToken == "" {
-		// Log and treat this as a successful "no-op" or permanent user preference issue.
-		return models.UserData{}, fmt.Errorf("user has no push token; skipping delivery")
+	if !userData.IsActive {
+		// Deactivated accounts are not notified; like a missing device, this is not a failure.
+		return models.UserData{}, models.Permanent(fmt.Errorf("user is inactive: %w", models.ErrNothingToDeliver))
+	}
+	if len(userData.DeviceList()) == 0 {
+		// A user preference, not a failure: the job is dropped rather than dead-lettered.
+		return models.UserData{}, models.Permanent(fmt.Errorf("user has no push devices: %w", models.ErrNothingToDeliver))
 	}
 	return userData, nil
 }
 
 // fetchTemplateData mocks the synchronous REST call to the Template Service.
-func (w *PushWorker) fetchTemplateData(templateID string) (models.TemplateData, error) {
+func (w *PushWorker) fetchTemplateData(ctx context.Context, templateID string) (models.TemplateData, error) {
 	url := fmt.Sprintf("%s/%s", w.TemplateServiceURL, templateID)
-	resp, err := w.HTTPClient.Get(url)
+	resp, err := w.get(ctx, url)
 	if err != nil {
-		return models.TemplateData{}, err
+		return models.TemplateData{}, models.Transient(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return models.TemplateData{}, fmt.Errorf("template service returned status %d", resp.StatusCode)
+		return models.TemplateData{}, statusError("template service", resp)
 	}
-	
+
 	var apiResp models.StandardizedResponse
 	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return models.TemplateData{}, fmt.Errorf("failed to decode template service response: %w", err)
+		return models.TemplateData{}, models.Permanent(fmt.Errorf("failed to decode template service response: %w", err))
 	}
 
 	if !apiResp.Success || apiResp.Data == nil {
-		return models.TemplateData{}, fmt.Errorf("template service failed: %s", apiResp.Message)
+		return models.TemplateData{}, models.Permanent(fmt.Errorf("template service failed: %s", apiResp.Message))
 	}
 
 	dataBytes, _ := json.Marshal(apiResp.Data)
 	var templateData models.TemplateData
 	if err := json.Unmarshal(dataBytes, &templateData); err != nil {
-		return models.TemplateData{}, fmt.Errorf("failed to parse template data payload: %w", err)
+		return models.TemplateData{}, models.Permanent(fmt.Errorf("failed to parse template data payload: %w", err))
 	}
 
 	return templateData, nil
 }
 
+// get issues a GET request that is aborted when ctx is cancelled.
+func (w *PushWorker) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return w.HTTPClient.Do(req)
+}
+
 // renderTemplate fills the variables into the template strings.
 func (w *PushWorker) renderTemplate(data models.TemplateData, variables map[string]string) (title string, body string, err error) {
-	
+
 	ctx := struct {
 		Vars map[string]string
 	}{
@@ -294,15 +503,23 @@ func (w *PushWorker) renderTemplate(data models.TemplateData, variables map[stri
 
 	// Render Title
 	titleTmpl, err := template.New("title").Parse(data.Title)
-	if err != nil { return "", "", fmt.Errorf("failed to parse title template: %w", err) }
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse title template: %w", err)
+	}
 	var titleBuilder strings.Builder
-	if err := titleTmpl.Execute(&titleBuilder, ctx); err != nil { return "", "", fmt.Errorf("failed to execute title template: %w", err) }
+	if err := titleTmpl.Execute(&titleBuilder, ctx); err != nil {
+		return "", "", fmt.Errorf("failed to execute title template: %w", err)
+	}
 
 	// Render Body
 	bodyTmpl, err := template.New("body").Parse(data.Body)
-	if err != nil { return "", "", fmt.Errorf("failed to parse body template: %w", err) }
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse body template: %w", err)
+	}
 	var bodyBuilder strings.Builder
-	if err := bodyTmpl.Execute(&bodyBuilder, ctx); err != nil { return "", "", fmt.Errorf("failed to execute body template: %w", err) }
+	if err := bodyTmpl.Execute(&bodyBuilder, ctx); err != nil {
+		return "", "", fmt.Errorf("failed to execute body template: %w", err)
+	}
 
 	return titleBuilder.String(), bodyBuilder.String(), nil
-}
\ No newline at end of file
+}
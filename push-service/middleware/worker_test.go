@@ -0,0 +1,327 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ezrahel/models"
+	"github.com/streadway/amqp"
+)
+
+// fakePublisher records every publish instead of talking to RabbitMQ.
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []publishedMessage
+	err       error
+}
+
+type publishedMessage struct {
+	Exchange, Key string
+	Msg           amqp.Publishing
+}
+
+func (p *fakePublisher) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, publishedMessage{Exchange: exchange, Key: key, Msg: msg})
+	return nil
+}
+
+// byKey returns the bodies published with the given routing key.
+func (p *fakePublisher) byKey(key string) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var bodies [][]byte
+	for _, m := range p.published {
+		if m.Key == key {
+			bodies = append(bodies, m.Msg.Body)
+		}
+	}
+	return bodies
+}
+
+// deadLettered returns the messages the worker published to the DLQ.
+func (p *fakePublisher) deadLettered() []amqp.Publishing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var msgs []amqp.Publishing
+	for _, m := range p.published {
+		if m.Exchange == "notifications.dlx" {
+			msgs = append(msgs, m.Msg)
+		}
+	}
+	return msgs
+}
+
+func (p *fakePublisher) statuses(t *testing.T) []models.NotificationStatusEvent {
+	t.Helper()
+	var events []models.NotificationStatusEvent
+	for _, body := range p.byKey("notifications.status") {
+		var e models.NotificationStatusEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatalf("bad status event %s: %v", body, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// fakeAcknowledger records what the worker did with a delivery.
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	outcome string // "ack", "nack", "reject" or "requeue"
+}
+
+func (a *fakeAcknowledger) set(outcome string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.outcome = outcome
+	return nil
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error { return a.set("ack") }
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		return a.set("requeue")
+	}
+	return a.set("nack")
+}
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		return a.set("requeue")
+	}
+	return a.set("reject")
+}
+
+func (a *fakeAcknowledger) get() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.outcome
+}
+
+// fakeProvider delivers through a function so each test can script the provider's answers.
+// invalid, when set, decides which send errors mean a dead token.
+type fakeProvider struct {
+	name    string
+	send    func(msg models.PushMessage) (string, error)
+	invalid func(err error) bool
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) Send(ctx context.Context, msg models.PushMessage) (string, error) {
+	return p.send(msg)
+}
+
+func (p *fakeProvider) SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error) {
+	results := make([]models.SendResult, len(msgs))
+	for i, msg := range msgs {
+		id, err := p.send(msg)
+		results[i] = models.SendResult{Token: msg.Token, MessageID: id, Error: err}
+	}
+	return results, nil
+}
+
+func (p *fakeProvider) ClassifyError(err error) models.ErrorClass { return models.ClassOf(err) }
+func (p *fakeProvider) IsTokenInvalid(err error) bool             { return p.invalid != nil && p.invalid(err) }
+func (p *fakeProvider) RetryAfter(err error) time.Duration        { return models.RetryAfterOf(err) }
+
+// testWorker wires a worker to fakes: miniredis, a recording publisher, and one HTTP server
+// playing both the User Service (/users/...) and the Template Service (/templates/...).
+type testWorker struct {
+	*PushWorker
+	pub   *fakePublisher
+	redis *miniredis.Miniredis
+}
+
+func newTestWorker(t testing.TB, provider PushProvider, users http.HandlerFunc) *testWorker {
+	t.Helper()
+	mr, rdb := newTestRedis(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", users)
+	mux.HandleFunc("/templates/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true,"data":{"title":"Hi {{.Vars.name}}","body":"Welcome"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cfg := Config{
+		QueueName:                  "push.queue",
+		DLXName:                    "notifications.dlx",
+		ExchangeName:               "notifications.direct",
+		StatusRoutingKey:           "notifications.status",
+		TokenInvalidatedRoutingKey: "push.token.invalidated",
+		UserServiceURL:             srv.URL + "/users",
+		TemplateServiceURL:         srv.URL + "/templates",
+		MaxRetries:                 5,
+		InstanceID:                 "worker-test",
+		RetryDelays:                DefaultRetryDelays,
+		RetryJitter:                0.2,
+		IdempotencyPrefix:          "push:processed:",
+		IdempotencyTTL:             time.Hour,
+		ProcessingLeaseTTL:         30 * time.Second,
+		InvalidTokenTTL:            time.Hour,
+		ThrottleMaxPause:           time.Minute,
+		HTTPTimeout:                time.Second,
+		BreakerMinRequests:         10,
+		BreakerFailureRatio:        0.6,
+		BreakerOpenTimeout:         5 * time.Second,
+		BreakerHalfOpenRequests:    1,
+	}
+	pub := &fakePublisher{}
+	return &testWorker{PushWorker: NewPushWorker(pub, rdb, provider, cfg), pub: pub, redis: mr}
+}
+
+// userWithDevices answers the User Service lookup with the given device tokens.
+func userWithDevices(tokens ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var devices []models.Device
+		for _, tok := range tokens {
+			devices = append(devices, models.Device{Token: tok, Platform: models.PlatformAndroid})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    models.UserData{Devices: devices, IsActive: true},
+		})
+	}
+}
+
+func (tw *testWorker) process(t *testing.T, job models.PushNotificationJob) *fakeAcknowledger {
+	t.Helper()
+	body, _ := json.Marshal(job)
+	ack := &fakeAcknowledger{}
+	tw.ProcessMessage(context.Background(), amqp.Delivery{Acknowledger: ack, Body: body})
+	return ack
+}
+
+func statusList(events []models.NotificationStatusEvent) string {
+	var s []string
+	for _, e := range events {
+		s = append(s, string(e.Status))
+	}
+	return strings.Join(s, ",")
+}
+
+func TestProcessMessagePublishesDeliveredStatus(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(msg models.PushMessage) (string, error) {
+		return "msg-" + msg.Token, nil
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1", "tok-2"))
+
+	ack := tw.process(t, models.PushNotificationJob{NotificationID: "n-1", RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+
+	events := tw.pub.statuses(t)
+	if got := statusList(events); got != "pending,delivered" {
+		t.Fatalf("statuses = %s, want pending,delivered", got)
+	}
+	delivered := events[1]
+	if delivered.NotificationID != "n-1" || delivered.Service != "push" || delivered.Error != "" {
+		t.Errorf("unexpected delivered event %+v", delivered)
+	}
+	if strings.Join(delivered.MessageIDs, ",") != "msg-tok-1,msg-tok-2" {
+		t.Errorf("message IDs = %v", delivered.MessageIDs)
+	}
+}
+
+func TestProcessMessagePublishesFailedStatusOnPermanentFailure(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"success":false,"message":"user not found"}`, http.StatusNotFound)
+	})
+
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-2", UserID: "missing", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack after publishing to the DLQ", ack.get())
+	}
+	if n := len(tw.pub.deadLettered()); n != 1 {
+		t.Fatalf("%d DLQ copies published, want 1", n)
+	}
+
+	events := tw.pub.statuses(t)
+	if got := statusList(events); got != "pending,failed" {
+		t.Fatalf("statuses = %s, want pending,failed", got)
+	}
+	if events[1].NotificationID != "r-2" {
+		t.Errorf("notification_id = %q, want the request ID as fallback", events[1].NotificationID)
+	}
+	if !strings.Contains(events[1].Error, "404") {
+		t.Errorf("error = %q, want the user service status", events[1].Error)
+	}
+}
+
+func TestProcessMessageKeepsStatusPendingWhileRetrying(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		return "", models.Transient(errors.New("fcm unavailable"))
+	}}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-3", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack after re-publishing", ack.get())
+	}
+	if n := len(tw.pub.byKey("push.queue.retry.5s")); n != 1 {
+		t.Fatalf("%d retries published to the 5s tier, want 1", n)
+	}
+
+	events := tw.pub.statuses(t)
+	if got := statusList(events); got != "pending,pending" {
+		t.Fatalf("statuses = %s, want pending,pending", got)
+	}
+	if !strings.Contains(events[1].Error, "fcm unavailable") {
+		t.Errorf("retry status error = %q", events[1].Error)
+	}
+}
+
+func TestProcessMessagePublishesFailedStatusAfterMaxRetries(t *testing.T) {
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) { return "id", nil }}
+	tw := newTestWorker(t, provider, userWithDevices("tok-1"))
+
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-4", UserID: "u-1", TemplateID: "welcome", RetryCount: 5})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack after publishing to the DLQ", ack.get())
+	}
+	if n := len(tw.pub.deadLettered()); n != 1 {
+		t.Fatalf("%d DLQ copies published, want 1", n)
+	}
+	if got := statusList(tw.pub.statuses(t)); got != "failed" {
+		t.Errorf("statuses = %s, want failed", got)
+	}
+}
+
+func TestProcessMessageDropsJobForInactiveUser(t *testing.T) {
+	sent := 0
+	provider := &fakeProvider{name: "fcm", send: func(models.PushMessage) (string, error) {
+		sent++
+		return "id", nil
+	}}
+	tw := newTestWorker(t, provider, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    models.UserData{Devices: []models.Device{{Token: "tok-1", Platform: models.PlatformAndroid}}},
+		})
+	})
+
+	ack := tw.process(t, models.PushNotificationJob{RequestID: "r-1", UserID: "u-1", TemplateID: "welcome"})
+	if ack.get() != "ack" {
+		t.Fatalf("delivery outcome = %q, want ack", ack.get())
+	}
+	if sent != 0 || len(tw.pub.byKey("push.queue.retry.5s")) != 0 || len(tw.pub.deadLettered()) != 0 {
+		t.Errorf("%d sends, %d retries, %d DLQ copies for an inactive user; want the job dropped",
+			sent, len(tw.pub.byKey("push.queue.retry.5s")), len(tw.pub.deadLettered()))
+	}
+}
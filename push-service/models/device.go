@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Device is one push target registered for a user (phone, tablet or browser).
+type Device struct {
+	Token        string               `json:"token"`
+	Platform     string               `json:"platform"`               // "ios", "android" or "web"
+	Provider     string               `json:"provider,omitempty"`     // Preferred provider for this device
+	AppID        string               `json:"app_id,omitempty"`       // APNs topic / OneSignal app the token belongs to
+	LastSeen     time.Time            `json:"last_seen"`              // Last time the device checked in
+	Subscription *WebPushSubscription `json:"subscription,omitempty"` // Set for browser (Web Push) devices
+}
+
+// DeviceResult records the outcome of delivering a job to one device.
+type DeviceResult struct {
+	Token     string     `json:"token"`
+	Provider  string     `json:"provider"`
+	MessageID string     `json:"message_id,omitempty"`
+	Class     ErrorClass `json:"class,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Skipped   bool       `json:"skipped,omitempty"` // Already delivered by an earlier attempt
+
+	RetryAfter time.Duration `json:"retry_after,omitempty"` // Back-off the provider asked for
+
+	TokenInvalid bool `json:"token_invalid,omitempty"` // Provider reported the token as dead
+}
+
+// DeviceList returns every device to notify. Users returned by older User Service versions only
+// carry a single push_token and/or web_push_subscription; those are converted into devices.
+func (u UserData) DeviceList() []Device {
+	if len(u.Devices) > 0 {
+		return u.Devices
+	}
+
+	var devices []Device
+	if u.PushToken != "" {
+		devices = append(devices, Device{Token: u.PushToken, Platform: u.Platform})
+	}
+	if u.WebPush != nil && u.WebPush.Endpoint != "" {
+		devices = append(devices, Device{Token: u.WebPush.Endpoint, Platform: PlatformWeb, Subscription: u.WebPush})
+	}
+	return devices
+}
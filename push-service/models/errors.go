@@ -0,0 +1,83 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrNothingToDeliver marks jobs that are valid but have no one to notify (no devices, inactive user).
+// They are acknowledged and dropped instead of being retried or dead-lettered.
+var ErrNothingToDeliver = errors.New("nothing to deliver")
+
+// ClassifiedError attaches an ErrorClass, and optionally a retry-after hint, to an error.
+type ClassifiedError struct {
+	Class      ErrorClass
+	RetryAfter time.Duration // Minimum delay before retrying, when the failing service asked for one
+	Err        error
+}
+
+func (e *ClassifiedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (%s, retry after %s)", e.Err, e.Class, e.RetryAfter)
+	}
+	return fmt.Sprintf("%s (%s)", e.Err, e.Class)
+}
+
+func (e *ClassifiedError) Unwrap() error { return e.Err }
+
+// Permanent marks err as a failure that will never succeed on retry.
+func Permanent(err error) error {
+	return &ClassifiedError{Class: ErrorClassPermanent, Err: err}
+}
+
+// Transient marks err as a failure worth retrying.
+func Transient(err error) error {
+	return &ClassifiedError{Class: ErrorClassTransient, Err: err}
+}
+
+// Throttled marks err as a rate-limit rejection; retryAfter may be zero when no hint was given.
+func Throttled(err error, retryAfter time.Duration) error {
+	return &ClassifiedError{Class: ErrorClassThrottled, RetryAfter: retryAfter, Err: err}
+}
+
+// ClassOf returns the class of the outermost ClassifiedError in err's chain.
+// Unclassified errors are treated as transient, which is the safe default.
+func ClassOf(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	var ce *ClassifiedError
+	if errors.As(err, &ce) {
+		return ce.Class
+	}
+	return ErrorClassTransient
+}
+
+// RetryAfterOf returns the retry-after hint carried by err, or zero.
+func RetryAfterOf(err error) time.Duration {
+	var ce *ClassifiedError
+	if errors.As(err, &ce) {
+		return ce.RetryAfter
+	}
+	return 0
+}
+
+// ParseRetryAfter accepts both forms of the Retry-After header: delay-seconds and HTTP-date.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
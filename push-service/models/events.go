@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// TokenInvalidatedEvent is published on push.token.invalidated when a provider reports a dead
+// device token, so the User Service can delete it.
+type TokenInvalidatedEvent struct {
+	UserID    string    `json:"user_id"`
+	Token     string    `json:"token"`
+	Platform  string    `json:"platform,omitempty"`
+	Provider  string    `json:"provider"`
+	Reason    string    `json:"reason"`
+	RequestID string    `json:"request_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NotificationStatus is the lifecycle state the API Gateway tracks for every notification.
+type NotificationStatus string
+
+const (
+	StatusPending   NotificationStatus = "pending"
+	StatusDelivered NotificationStatus = "delivered"
+	StatusFailed    NotificationStatus = "failed"
+)
+
+// ServicePush identifies this service in status events; the Email service sends "email".
+const ServicePush = "push"
+
+// NotificationStatusEvent is published on notifications.status at each step of a job's lifecycle.
+// It has the shape the API Gateway's StatusListenerService consumes from the Email service.
+type NotificationStatusEvent struct {
+	NotificationID string             `json:"notification_id"`
+	Status         NotificationStatus `json:"status"`
+	Timestamp      time.Time          `json:"timestamp"`
+	Error          string             `json:"error,omitempty"`
+	Service        string             `json:"service"`
+	MessageIDs     []string           `json:"message_ids,omitempty"` // Provider message IDs of the devices reached
+}
@@ -1,20 +1,33 @@
 package models
 
 type PushNotificationJob struct {
+	NotificationID string          `json:"notification_id,omitempty"` // Gateway ID used in status events; defaults to RequestID
 	RequestID    string            `json:"request_id"`    
 	UserID       string            `json:"user_id"`     
 	TemplateID   string            `json:"template_id"`  
 	Variables    map[string]string `json:"variables"`    
 	CorrelationID string            `json:"correlation_id"` 
 	RetryCount   int               `json:"retry_count"`   
+	Provider     string            `json:"provider,omitempty"` // Optional override, e.g. "onesignal"
 }
 
 type UserData struct {
-	PushToken string `json:"push_token"` 
+	Devices   []Device `json:"devices"` // All registered devices; takes precedence over the legacy fields below
+	PushToken string `json:"push_token"` // Deprecated: single-device token, use Devices
+	Platform  string `json:"platform"` // "ios", "android" or "web"
+	WebPush   *WebPushSubscription `json:"web_push_subscription"` // Deprecated: use Devices
+	Provider  string `json:"provider"` // Preferred push provider for this user, e.g. "onesignal"
 	Language  string `json:"language"`
 	IsActive  bool   `json:"is_active"`
 }
 
+// Device platforms reported by the User Service.
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformWeb     = "web"
+)
+
 type TemplateData struct {
 	Title   string `json:"title"`
 	Body    string `json:"body"`
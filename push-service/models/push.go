@@ -0,0 +1,46 @@
+package models
+
+// PushMessage is a fully rendered notification addressed to a single device.
+type PushMessage struct {
+	Token    string            `json:"token"`
+	Title    string            `json:"title"`
+	Body     string            `json:"body"`
+	LinkURL  string            `json:"link_url"`
+	ImageURL string            `json:"image_url"`
+	Data     map[string]string `json:"data"`
+	AppID    string            `json:"app_id,omitempty"` // Overrides the provider's configured app (APNs topic, OneSignal app)
+
+	// Subscription is only set for Web Push deliveries, where Token is the endpoint.
+	Subscription *WebPushSubscription `json:"subscription,omitempty"`
+}
+
+// WebPushSubscription mirrors the browser's PushSubscription.toJSON() output.
+type WebPushSubscription struct {
+	Endpoint string      `json:"endpoint"`
+	Keys     WebPushKeys `json:"keys"`
+}
+
+// WebPushKeys are the base64url encoded client keys used to encrypt the payload.
+type WebPushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// SendResult is the outcome of delivering one PushMessage from a batch.
+type SendResult struct {
+	Token     string
+	MessageID string
+	Error     error
+}
+
+// ErrorClass tells the worker how a failed delivery should be handled.
+type ErrorClass string
+
+const (
+	// ErrorClassTransient failures are retried with the normal retry policy.
+	ErrorClassTransient ErrorClass = "transient"
+	// ErrorClassPermanent failures will never succeed and must not be retried.
+	ErrorClassPermanent ErrorClass = "permanent"
+	// ErrorClassThrottled failures are retried once the provider stops rate limiting us.
+	ErrorClassThrottled ErrorClass = "throttled"
+)
@@ -0,0 +1,334 @@
+package onesignal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+// ProviderName is the name the OneSignal provider is registered under.
+const ProviderName = "onesignal"
+
+// DefaultBaseURL is the OneSignal REST API endpoint.
+const DefaultBaseURL = "https://api.onesignal.com"
+
+// maxRecipients is the OneSignal limit of subscription IDs per notification.
+const maxRecipients = 2000
+
+// Config holds the OneSignal app credentials.
+type Config struct {
+	AppID      string
+	APIKey     string       // REST API key of the app
+	BaseURL    string       // Overrides DefaultBaseURL (used for local test servers)
+	HTTPClient *http.Client // Optional, defaults to a client with a 10s timeout
+}
+
+// Provider delivers notifications through the OneSignal REST API, addressed by
+// subscription ID (formerly player ID).
+type Provider struct {
+	cfg     Config
+	baseURL string
+	client  *http.Client
+
+	mu           sync.Mutex
+	blockedUntil time.Time // Set from the rate-limit headers of the last response
+}
+
+// Error is a failed OneSignal request or a notification that reached no recipients.
+type Error struct {
+	StatusCode   int
+	Errors       []string
+	RetryAfter   time.Duration // Set when OneSignal asked us to back off
+	InvalidToken bool          // OneSignal listed this subscription ID as invalid
+}
+
+// errInvalidSubscription is the result for a subscription ID OneSignal listed in invalid_player_ids
+// or invalid_subscription_ids.
+func errInvalidSubscription() *Error {
+	return &Error{Errors: []string{"subscription is invalid or unsubscribed"}, InvalidToken: true}
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return "onesignal: " + strings.Join(e.Errors, "; ")
+	}
+	return fmt.Sprintf("onesignal responded with status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+type notificationRequest struct {
+	AppID           string            `json:"app_id"`
+	SubscriptionIDs []string          `json:"include_subscription_ids"`
+	Headings        map[string]string `json:"headings"`
+	Contents        map[string]string `json:"contents"`
+	URL             string            `json:"url,omitempty"`
+	BigPicture      string            `json:"big_picture,omitempty"`
+	IOSAttachments  map[string]string `json:"ios_attachments,omitempty"`
+	ChromeWebImage  string            `json:"chrome_web_image,omitempty"`
+	Data            map[string]string `json:"data,omitempty"`
+}
+
+type notificationResponse struct {
+	ID string `json:"id"`
+	// Errors is either a list of messages or an object such as {"invalid_player_ids": [...]}.
+	Errors json.RawMessage `json:"errors"`
+}
+
+// NewProvider validates the app credentials.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.AppID == "" || cfg.APIKey == "" {
+		return nil, errors.New("onesignal: app ID and API key are required")
+	}
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, baseURL: strings.TrimRight(baseURL, "/"), client: client}, nil
+}
+
+// Name implements middleware.PushProvider.
+func (p *Provider) Name() string { return ProviderName }
+
+// Send creates a notification for a single subscription ID and returns the OneSignal notification ID.
+func (p *Provider) Send(ctx context.Context, msg models.PushMessage) (string, error) {
+	id, invalid, err := p.send(ctx, msg, []string{msg.Token})
+	if invalid[msg.Token] {
+		return "", errInvalidSubscription()
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SendBatch groups messages with identical content into a single notification of up to
+// 2000 subscription IDs, then reports per-subscription results.
+func (p *Provider) SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error) {
+	results := make([]models.SendResult, len(msgs))
+
+	groups := map[string][]int{}
+	var order []string
+	for i, msg := range msgs {
+		key := contentKey(msg)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	for _, key := range order {
+		indexes := groups[key]
+		for start := 0; start < len(indexes); start += maxRecipients {
+			end := min(start+maxRecipients, len(indexes))
+			chunk := indexes[start:end]
+
+			tokens := make([]string, len(chunk))
+			for j, i := range chunk {
+				tokens[j] = msgs[i].Token
+			}
+
+			id, invalid, err := p.send(ctx, msgs[chunk[0]], tokens)
+			for _, i := range chunk {
+				results[i] = models.SendResult{Token: msgs[i].Token, MessageID: id, Error: err}
+				if invalid[msgs[i].Token] {
+					results[i].MessageID = ""
+					results[i].Error = errInvalidSubscription()
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// ClassifyError maps OneSignal responses to the worker's failure classes.
+func (p *Provider) ClassifyError(err error) models.ErrorClass {
+	if err == nil {
+		return ""
+	}
+	var osErr *Error
+	if !errors.As(err, &osErr) {
+		return models.ErrorClassTransient
+	}
+
+	switch {
+	case osErr.StatusCode == 0:
+		// The request succeeded but reached nobody; sending it again would not change that.
+		return models.ErrorClassPermanent
+	case osErr.StatusCode == http.StatusTooManyRequests:
+		return models.ErrorClassThrottled
+	case osErr.StatusCode >= 500:
+		return models.ErrorClassTransient
+	case osErr.StatusCode == http.StatusUnauthorized, osErr.StatusCode == http.StatusForbidden:
+		// Bad API key affects every notification; retry while it is being fixed.
+		return models.ErrorClassTransient
+	default:
+		return models.ErrorClassPermanent
+	}
+}
+
+// IsTokenInvalid reports subscriptions OneSignal listed as invalid or unsubscribed. Other
+// notifications that reached no recipients, such as app-level errors, say nothing about the
+// subscription itself.
+func (p *Provider) IsTokenInvalid(err error) bool {
+	var osErr *Error
+	return errors.As(err, &osErr) && osErr.InvalidToken
+}
+
+// RetryAfter returns how long OneSignal's rate limit still blocks us, as reported with the error.
+func (p *Provider) RetryAfter(err error) time.Duration {
+	var osErr *Error
+	if errors.As(err, &osErr) {
+		return osErr.RetryAfter
+	}
+	return 0
+}
+
+// send performs one create-notification call and returns the notification ID and the set of
+// subscription IDs OneSignal reported as invalid. The set is also returned with the error of a
+// notification that reached no recipients.
+func (p *Provider) send(ctx context.Context, msg models.PushMessage, tokens []string) (string, map[string]bool, error) {
+	if wait := p.rateLimitWait(); wait > 0 {
+		// Don't spend a request we know will be rejected.
+		return "", nil, &Error{StatusCode: http.StatusTooManyRequests, Errors: []string{"rate limit exhausted"}, RetryAfter: wait}
+	}
+
+	appID := p.cfg.AppID
+	if msg.AppID != "" {
+		appID = msg.AppID
+	}
+	reqBody := notificationRequest{
+		AppID:           appID,
+		SubscriptionIDs: tokens,
+		Headings:        map[string]string{"en": msg.Title},
+		Contents:        map[string]string{"en": msg.Body},
+		URL:             msg.LinkURL,
+		Data:            msg.Data,
+	}
+	if msg.ImageURL != "" {
+		reqBody.BigPicture = msg.ImageURL
+		reqBody.ChromeWebImage = msg.ImageURL
+		reqBody.IOSAttachments = map[string]string{"image": msg.ImageURL}
+	}
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", nil, fmt.Errorf("onesignal: failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/notifications", bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Authorization", "Key "+p.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("onesignal request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	p.updateRateLimit(resp)
+
+	var out notificationResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&out)
+	errs, invalid := parseErrors(out.Errors)
+
+	if resp.StatusCode != http.StatusOK {
+		osErr := &Error{StatusCode: resp.StatusCode, Errors: errs}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			osErr.RetryAfter = p.rateLimitWait()
+		}
+		return "", nil, osErr
+	}
+	if decodeErr != nil {
+		return "", nil, fmt.Errorf("onesignal: failed to decode response: %w", decodeErr)
+	}
+	if out.ID == "" {
+		// OneSignal answers 200 with an empty ID when no recipient was reachable. Only the IDs it
+		// lists as invalid are dead; the others fail without being blamed.
+		if len(errs) == 0 {
+			errs = []string{"notification has no recipients"}
+		}
+		return "", invalid, &Error{Errors: errs}
+	}
+	return out.ID, invalid, nil
+}
+
+// updateRateLimit records when we may call OneSignal again, based on Retry-After or the
+// X-RateLimit-Remaining / X-RateLimit-Reset headers.
+func (p *Provider) updateRateLimit(resp *http.Response) {
+	var until time.Time
+
+	if wait := models.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); wait > 0 {
+		until = time.Now().Add(wait)
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			until = time.Unix(reset, 0)
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && until.IsZero() {
+		until = time.Now().Add(time.Second)
+	}
+	if until.IsZero() {
+		return
+	}
+
+	p.mu.Lock()
+	if until.After(p.blockedUntil) {
+		p.blockedUntil = until
+	}
+	p.mu.Unlock()
+}
+
+// rateLimitWait returns how long we still have to wait before the next request.
+func (p *Provider) rateLimitWait() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Until(p.blockedUntil)
+}
+
+// parseErrors handles both shapes of the "errors" field.
+func parseErrors(raw json.RawMessage) ([]string, map[string]bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+
+	var obj map[string][]string
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return []string{string(raw)}, nil
+	}
+	invalid := map[string]bool{}
+	var msgs []string
+	for kind, ids := range obj {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", kind, strings.Join(ids, ",")))
+		if kind == "invalid_player_ids" || kind == "invalid_subscription_ids" {
+			for _, id := range ids {
+				invalid[id] = true
+			}
+		}
+	}
+	return msgs, invalid
+}
+
+// contentKey identifies messages that can share one OneSignal notification.
+func contentKey(msg models.PushMessage) string {
+	data, _ := json.Marshal(msg.Data)
+	return strings.Join([]string{msg.AppID, msg.Title, msg.Body, msg.LinkURL, msg.ImageURL, string(data)}, "\x00")
+}
@@ -0,0 +1,173 @@
+package onesignal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+func newTestProvider(t *testing.T, handler http.HandlerFunc) *Provider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	p, err := NewProvider(Config{AppID: "app-1", APIKey: "secret", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSendBySubscriptionID(t *testing.T) {
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/notifications" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Key secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req notificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.AppID != "app-1" || len(req.SubscriptionIDs) != 1 || req.SubscriptionIDs[0] != "sub-1" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if req.Headings["en"] != "Hello" || req.URL != "https://example.com" {
+			t.Errorf("unexpected content %+v", req)
+		}
+		w.Write([]byte(`{"id":"notif-1"}`))
+	})
+
+	id, err := p.Send(context.Background(), models.PushMessage{Token: "sub-1", Title: "Hello", LinkURL: "https://example.com"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if id != "notif-1" {
+		t.Errorf("id = %q", id)
+	}
+}
+
+func TestSendUnsubscribedIsPermanent(t *testing.T) {
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"","errors":["All included players are not subscribed"]}`))
+	})
+
+	_, err := p.Send(context.Background(), models.PushMessage{Token: "sub-1"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := p.ClassifyError(err); got != models.ErrorClassPermanent {
+		t.Errorf("class = %s, want permanent", got)
+	}
+	if p.IsTokenInvalid(err) {
+		t.Error("a notification without recipients marked the subscription invalid")
+	}
+}
+
+func TestOnlyListedSubscriptionsAreInvalid(t *testing.T) {
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"","errors":{"invalid_subscription_ids":["sub-2"]}}`))
+	})
+
+	msgs := []models.PushMessage{{Token: "sub-1", Title: "Hi"}, {Token: "sub-2", Title: "Hi"}}
+	results, err := p.SendBatch(context.Background(), msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := results[1].Error; err == nil || !p.IsTokenInvalid(err) {
+		t.Errorf("sub-2: error %v, want an invalid subscription", err)
+	}
+	if err := results[0].Error; err == nil || p.IsTokenInvalid(err) || p.ClassifyError(err) != models.ErrorClassPermanent {
+		t.Errorf("sub-1: error %v, want a permanent failure that keeps the subscription", err)
+	}
+
+	// App-level errors come back the same way, without IDs.
+	p = newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"","errors":["Message Notifications must have English language content"]}`))
+	})
+	results, _ = p.SendBatch(context.Background(), msgs)
+	for _, r := range results {
+		if r.Error == nil || p.IsTokenInvalid(r.Error) {
+			t.Errorf("%s: error %v, want a failure that keeps the subscription", r.Token, r.Error)
+		}
+	}
+}
+
+func TestRateLimitHeadersAreHonoured(t *testing.T) {
+	var calls int32
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errors":["API rate limit exceeded"]}`))
+	})
+
+	_, err := p.Send(context.Background(), models.PushMessage{Token: "sub-1"})
+	osErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if p.ClassifyError(err) != models.ErrorClassThrottled {
+		t.Errorf("class = %s, want throttled", p.ClassifyError(err))
+	}
+	if osErr.RetryAfter < 29*time.Second {
+		t.Errorf("RetryAfter = %s, want ~30s", osErr.RetryAfter)
+	}
+
+	// The next send must not reach the server while we are blocked.
+	if _, err := p.Send(context.Background(), models.PushMessage{Token: "sub-2"}); p.ClassifyError(err) != models.ErrorClassThrottled {
+		t.Errorf("second send: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("server called %d times, want 1", n)
+	}
+}
+
+func TestRateLimitRemainingZeroBlocksUntilReset(t *testing.T) {
+	reset := time.Now().Add(time.Minute).Unix()
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		w.Write([]byte(`{"id":"notif-1"}`))
+	})
+
+	if _, err := p.Send(context.Background(), models.PushMessage{Token: "sub-1"}); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if wait := p.rateLimitWait(); wait < 50*time.Second {
+		t.Errorf("rateLimitWait = %s, want close to a minute", wait)
+	}
+}
+
+func TestSendBatchGroupsIdenticalContent(t *testing.T) {
+	var calls int32
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"id":"notif-1","errors":{"invalid_player_ids":["sub-2"]}}`))
+	})
+
+	msgs := []models.PushMessage{
+		{Token: "sub-1", Title: "Hi"},
+		{Token: "sub-2", Title: "Hi"},
+		{Token: "sub-3", Title: "Hi"},
+	}
+	results, err := p.SendBatch(context.Background(), msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected one API call, got %d", n)
+	}
+	if results[0].Error != nil || results[2].Error != nil {
+		t.Errorf("unexpected errors: %+v", results)
+	}
+	if results[1].Error == nil || p.ClassifyError(results[1].Error) != models.ErrorClassPermanent || !p.IsTokenInvalid(results[1].Error) {
+		t.Errorf("sub-2 should fail permanently as invalid, got %+v", results[1])
+	}
+}
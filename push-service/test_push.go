@@ -1,3 +1,6 @@
+//go:build ignore
+
+// Manual publisher for local testing: go run test_push.go [duplicate]
 package main
 
 import (
@@ -18,6 +21,7 @@ type PushNotificationJob struct {
 	Variables     map[string]string `json:"variables"`
 	CorrelationID string            `json:"correlation_id"`
 	RetryCount    int               `json:"retry_count"`
+	Provider      string            `json:"provider,omitempty"`
 }
 
 // RabbitMQ configuration values used by the push_service
@@ -0,0 +1,125 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// recordSize is the aes128gcm record size. Push services must accept at least 4096 bytes,
+// so every payload is sent as a single record of at most this size.
+const recordSize = 4096
+
+// headerLen is salt (16) + record size (4) + key id length (1) + uncompressed P-256 key (65).
+const headerLen = 16 + 4 + 1 + 65
+
+// ErrPayloadTooLarge is returned when the rendered notification does not fit in one record.
+var ErrPayloadTooLarge = errors.New("webpush: payload exceeds the 4096 byte record size")
+
+// ErrInvalidSubscription is returned when the subscription's keys cannot be used to encrypt for
+// it. Retrying cannot fix that; the browser has to subscribe again.
+var ErrInvalidSubscription = errors.New("webpush: invalid subscription")
+
+// Encrypt encrypts plaintext for a browser subscription using the aes128gcm content coding
+// (RFC 8188) with keys derived as described in RFC 8291.
+// p256dh and auth are the base64url values from the browser's PushSubscription.
+func Encrypt(plaintext []byte, p256dh, auth string) ([]byte, error) {
+	uaPublic, err := decodeBase64(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("%w: p256dh key: %w", ErrInvalidSubscription, err)
+	}
+	authSecret, err := decodeBase64(auth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: auth secret: %w", ErrInvalidSubscription, err)
+	}
+
+	// A fresh ephemeral key pair and salt are used for every message.
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encrypt(plaintext, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encrypt is the deterministic core of Encrypt, split out so it can be checked against RFC 8291 vectors.
+func encrypt(plaintext, uaPublicBytes, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext)+1+16 > recordSize-headerLen {
+		return nil, ErrPayloadTooLarge
+	}
+
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: user agent public key: %w", ErrInvalidSubscription, err)
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	cek, nonce, err := deriveKeys(asPrivate, uaPublic, uaPublicBytes, asPublicBytes, authSecret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single, final record: plaintext followed by the 0x02 padding delimiter.
+	record := make([]byte, 0, len(plaintext)+1)
+	record = append(record, plaintext...)
+	record = append(record, 0x02)
+
+	out := make([]byte, 0, headerLen+len(record)+gcm.Overhead())
+	out = append(out, salt...)
+	out = binary.BigEndian.AppendUint32(out, recordSize)
+	out = append(out, byte(len(asPublicBytes)))
+	out = append(out, asPublicBytes...)
+	return gcm.Seal(out, nonce, record, nil), nil
+}
+
+// deriveKeys computes the content encryption key and nonce (RFC 8291 section 3.4).
+// The same derivation is used by the user agent, with the roles of the private and public keys swapped.
+func deriveKeys(private *ecdh.PrivateKey, peer *ecdh.PublicKey, uaPublic, asPublic, authSecret, salt []byte) (cek, nonce []byte, err error) {
+	ecdhSecret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: ECDH failed: %w", ErrInvalidSubscription, err)
+	}
+
+	keyInfo := "WebPush: info\x00" + string(uaPublic) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cek, err = hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16); err != nil {
+		return nil, nil, err
+	}
+	if nonce, err = hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12); err != nil {
+		return nil, nil, err
+	}
+	return cek, nonce, nil
+}
+
+// decodeBase64 accepts both padded and unpadded base64url, since browsers and libraries disagree.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,80 @@
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// vapidTokenLifetime must stay under the 24 hour maximum allowed by RFC 8292.
+const vapidTokenLifetime = 12 * time.Hour
+
+// VAPIDKeys is an application server key pair in the base64url form browsers expect
+// (the public key is what the frontend passes as applicationServerKey).
+type VAPIDKeys struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+// GenerateVAPIDKeys creates a new P-256 application server key pair.
+func GenerateVAPIDKeys() (VAPIDKeys, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return VAPIDKeys{}, err
+	}
+	return VAPIDKeys{
+		PublicKey:  base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		PrivateKey: base64.RawURLEncoding.EncodeToString(key.Bytes()),
+	}, nil
+}
+
+// parseVAPIDPrivateKey converts the raw base64url scalar into an ECDSA signing key.
+func parseVAPIDPrivateKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	raw, err := decodeBase64(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid VAPID private key: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid VAPID private key: %w", err)
+	}
+
+	// Uncompressed point: 0x04 || X || Y.
+	pub := key.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}, nil
+}
+
+// vapidAuthorization builds the "vapid t=..., k=..." Authorization header (RFC 8292)
+// for the push service that hosts endpoint.
+func vapidAuthorization(endpoint, subject, publicKey string, key *ecdsa.PrivateKey, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("webpush: invalid endpoint: %w", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenLifetime).Unix(),
+		"sub": subject,
+	})
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("webpush: failed to sign VAPID token: %w", err)
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, publicKey), nil
+}
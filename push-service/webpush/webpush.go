@@ -0,0 +1,219 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ezrahel/models"
+)
+
+// ProviderName is the name the Web Push provider is registered under.
+const ProviderName = "webpush"
+
+// Config holds the VAPID application server identity.
+type Config struct {
+	PublicKey  string        // base64url uncompressed P-256 public key
+	PrivateKey string        // base64url raw P-256 private scalar
+	Subject    string        // Contact for the push service, "mailto:" or "https:" URL
+	TTL        time.Duration // How long the push service keeps undelivered messages, defaults to 24h
+	HTTPClient *http.Client  // Optional, defaults to a client with a 10s timeout
+}
+
+// Provider delivers encrypted notifications straight to browser push services (self-hosted Web Push).
+type Provider struct {
+	cfg    Config
+	key    *ecdsa.PrivateKey
+	client *http.Client
+}
+
+// Error is a non-2xx response from a browser push service.
+type Error struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // Retry-After sent with 429 and 503 responses, if any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("push service responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// notificationPayload is the JSON document the service worker receives in its push event.
+type notificationPayload struct {
+	Title   string            `json:"title"`
+	Body    string            `json:"body"`
+	LinkURL string            `json:"link_url,omitempty"`
+	Image   string            `json:"image,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// NewProvider validates the VAPID key pair and subject.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Subject == "" {
+		return nil, errors.New("webpush: VAPID subject is required")
+	}
+	key, err := parseVAPIDPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	derived := base64.RawURLEncoding.EncodeToString(ecdhPublicBytes(key))
+	if cfg.PublicKey == "" {
+		cfg.PublicKey = derived
+	} else if decoded, err := decodeBase64(cfg.PublicKey); err != nil || base64.RawURLEncoding.EncodeToString(decoded) != derived {
+		return nil, errors.New("webpush: VAPID public key does not match the private key")
+	}
+
+	if cfg.TTL == 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, key: key, client: client}, nil
+}
+
+// Name implements middleware.PushProvider.
+func (p *Provider) Name() string { return ProviderName }
+
+// Send encrypts the message for the subscription and posts it to the subscription endpoint.
+// The push service's Location header is returned as the message ID.
+func (p *Provider) Send(ctx context.Context, msg models.PushMessage) (string, error) {
+	sub := msg.Subscription
+	if sub == nil || sub.Endpoint == "" {
+		return "", fmt.Errorf("%w: message has no subscription", ErrInvalidSubscription)
+	}
+
+	plaintext, err := json.Marshal(notificationPayload{
+		Title:   msg.Title,
+		Body:    msg.Body,
+		LinkURL: msg.LinkURL,
+		Image:   msg.ImageURL,
+		Data:    msg.Data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("webpush: failed to encode payload: %w", err)
+	}
+
+	body, err := Encrypt(plaintext, sub.Keys.P256dh, sub.Keys.Auth)
+	if err != nil {
+		return "", err
+	}
+	auth, err := vapidAuthorization(sub.Endpoint, p.cfg.Subject, p.cfg.PublicKey, p.key, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(p.cfg.TTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("webpush request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &Error{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: models.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// SendBatch sends each message concurrently; every subscription may live on a different push service.
+func (p *Provider) SendBatch(ctx context.Context, msgs []models.PushMessage) ([]models.SendResult, error) {
+	results := make([]models.SendResult, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		go func(i int, msg models.PushMessage) {
+			defer wg.Done()
+			id, err := p.Send(ctx, msg)
+			results[i] = models.SendResult{Token: msg.Token, MessageID: id, Error: err}
+		}(i, msg)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// ClassifyError treats 404/410 and unusable subscription keys as dead subscriptions and 429 as
+// throttling.
+func (p *Provider) ClassifyError(err error) models.ErrorClass {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, ErrPayloadTooLarge) || errors.Is(err, ErrInvalidSubscription) {
+		return models.ErrorClassPermanent
+	}
+	var pushErr *Error
+	if !errors.As(err, &pushErr) {
+		return models.ErrorClassTransient
+	}
+
+	switch {
+	case pushErr.StatusCode == http.StatusNotFound, pushErr.StatusCode == http.StatusGone:
+		// The subscription expired or the user revoked permission.
+		return models.ErrorClassPermanent
+	case pushErr.StatusCode == http.StatusTooManyRequests:
+		return models.ErrorClassThrottled
+	case pushErr.StatusCode >= 500:
+		return models.ErrorClassTransient
+	case pushErr.StatusCode == http.StatusUnauthorized, pushErr.StatusCode == http.StatusForbidden:
+		// VAPID misconfiguration affects every subscription; keep retrying while it is fixed.
+		return models.ErrorClassTransient
+	default:
+		return models.ErrorClassPermanent
+	}
+}
+
+// IsTokenInvalid reports 404/410 responses, where the subscription expired or was revoked, and
+// subscriptions whose keys cannot be used.
+func (p *Provider) IsTokenInvalid(err error) bool {
+	if errors.Is(err, ErrInvalidSubscription) {
+		return true
+	}
+	var pushErr *Error
+	if !errors.As(err, &pushErr) {
+		return false
+	}
+	return pushErr.StatusCode == http.StatusNotFound || pushErr.StatusCode == http.StatusGone
+}
+
+// RetryAfter returns the back-off the push service asked for with a 429 or 503 response.
+func (p *Provider) RetryAfter(err error) time.Duration {
+	var pushErr *Error
+	if errors.As(err, &pushErr) {
+		return pushErr.RetryAfter
+	}
+	return 0
+}
+
+// ecdhPublicBytes returns the uncompressed encoding of the VAPID public key.
+func ecdhPublicBytes(key *ecdsa.PrivateKey) []byte {
+	pub := make([]byte, 65)
+	pub[0] = 0x04
+	key.X.FillBytes(pub[1:33])
+	key.Y.FillBytes(pub[33:])
+	return pub
+}
@@ -0,0 +1,260 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ezrahel/models"
+)
+
+// Test vectors from RFC 8291, Appendix A.
+const (
+	rfcPlaintext   = "When I grow up, I want to be a watermelon"
+	rfcASPrivate   = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcUAPrivate   = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcUAPublic    = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcSalt        = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuthSecret  = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcCiphertext  = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	rfcASPublicKey = "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64(s)
+	if err != nil {
+		t.Fatalf("decode %q: %v", s, err)
+	}
+	return b
+}
+
+// decrypt performs the user agent side of RFC 8291 for a single-record message.
+func decrypt(t *testing.T, body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) []byte {
+	t.Helper()
+	if len(body) < headerLen {
+		t.Fatalf("message too short: %d bytes", len(body))
+	}
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != recordSize {
+		t.Fatalf("record size = %d, want %d", rs, recordSize)
+	}
+	idLen := int(body[20])
+	asPublicBytes := body[21 : 21+idLen]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cek, nonce, err := deriveKeys(uaPrivate, asPublic, uaPrivate.PublicKey().Bytes(), asPublicBytes, authSecret, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	if err != nil {
+		t.Fatalf("decryption failed: %v", err)
+	}
+
+	// Strip the padding delimiter and any trailing zero padding.
+	end := bytes.LastIndexByte(record, 0x02)
+	if end < 0 {
+		t.Fatal("missing padding delimiter")
+	}
+	return record[:end]
+}
+
+func TestEncryptMatchesRFC8291Vector(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfcASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(asPrivate.PublicKey().Bytes()); got != rfcASPublicKey {
+		t.Fatalf("application server public key = %s", got)
+	}
+
+	got, err := encrypt([]byte(rfcPlaintext), mustDecode(t, rfcUAPublic), mustDecode(t, rfcAuthSecret), asPrivate, mustDecode(t, rfcSalt))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if enc := base64.RawURLEncoding.EncodeToString(got); enc != rfcCiphertext {
+		t.Errorf("ciphertext mismatch\n got: %s\nwant: %s", enc, rfcCiphertext)
+	}
+}
+
+func TestDecryptRFC8291Vector(t *testing.T) {
+	uaPrivate, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfcUAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := decrypt(t, mustDecode(t, rfcCiphertext), uaPrivate, mustDecode(t, rfcAuthSecret))
+	if string(plaintext) != rfcPlaintext {
+		t.Errorf("plaintext = %q, want %q", plaintext, rfcPlaintext)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	body, err := Encrypt(
+		[]byte(`{"title":"Hi"}`),
+		base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		base64.URLEncoding.EncodeToString(authSecret), // padded form must be accepted too
+	)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if got := decrypt(t, body, uaPrivate, authSecret); string(got) != `{"title":"Hi"}` {
+		t.Errorf("round trip = %q", got)
+	}
+}
+
+func TestEncryptRejectsOversizedPayload(t *testing.T) {
+	_, err := Encrypt(make([]byte, recordSize), rfcUAPublic, rfcAuthSecret)
+	if err != ErrPayloadTooLarge {
+		t.Errorf("err = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestSendPostsEncryptedPayloadWithVAPID(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPrivate, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("Content-Encoding = %q", r.Header.Get("Content-Encoding"))
+		}
+
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "vapid ")
+		parts := strings.SplitN(auth, ", ", 2)
+		if len(parts) != 2 || parts[1] != "k="+keys.PublicKey {
+			t.Fatalf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		key, _ := parseVAPIDPrivateKey(keys.PrivateKey)
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(strings.TrimPrefix(parts[0], "t="), claims, func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		}); err != nil {
+			t.Errorf("invalid VAPID token: %v", err)
+		}
+		if claims["aud"] != srvURL || claims["sub"] != "mailto:ops@example.com" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		var payload notificationPayload
+		json.Unmarshal(decrypt(t, body, uaPrivate, authSecret), &payload)
+		if payload.Title != "Hello" || payload.LinkURL != "https://example.com" {
+			t.Errorf("unexpected payload %+v", payload)
+		}
+
+		w.Header().Set("Location", "https://push.example.com/m/1")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	p, err := NewProvider(Config{PublicKey: keys.PublicKey, PrivateKey: keys.PrivateKey, Subject: "mailto:ops@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := p.Send(context.Background(), models.PushMessage{
+		Title:   "Hello",
+		Body:    "World",
+		LinkURL: "https://example.com",
+		Subscription: &models.WebPushSubscription{
+			Endpoint: srv.URL + "/push/abc",
+			Keys: models.WebPushKeys{
+				P256dh: base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+				Auth:   base64.RawURLEncoding.EncodeToString(authSecret),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if id != "https://push.example.com/m/1" {
+		t.Errorf("message ID = %q", id)
+	}
+}
+
+func TestClassifyErrorTreatsGoneAsPermanent(t *testing.T) {
+	p := &Provider{}
+	tests := []struct {
+		status int
+		want   models.ErrorClass
+	}{
+		{http.StatusNotFound, models.ErrorClassPermanent},
+		{http.StatusGone, models.ErrorClassPermanent},
+		{http.StatusTooManyRequests, models.ErrorClassThrottled},
+		{http.StatusBadGateway, models.ErrorClassTransient},
+	}
+	for _, tt := range tests {
+		if got := p.ClassifyError(&Error{StatusCode: tt.status}); got != tt.want {
+			t.Errorf("status %d: got %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestUnusableSubscriptionIsPermanentAndInvalid(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProvider(Config{PublicKey: keys.PublicKey, PrivateKey: keys.PrivateKey, Subject: "mailto:ops@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]*models.WebPushSubscription{
+		"no subscription":   nil,
+		"p256dh not base64": {Endpoint: "https://push.example.com/abc", Keys: models.WebPushKeys{P256dh: "not base64!", Auth: "c2VjcmV0"}},
+		"p256dh not a key":  {Endpoint: "https://push.example.com/abc", Keys: models.WebPushKeys{P256dh: "AAAA", Auth: "c2VjcmV0"}},
+	}
+	for name, sub := range tests {
+		_, err := p.Send(context.Background(), models.PushMessage{Title: "Hello", Subscription: sub})
+		if !errors.Is(err, ErrInvalidSubscription) {
+			t.Errorf("%s: err = %v, want ErrInvalidSubscription", name, err)
+		}
+		if got := p.ClassifyError(err); got != models.ErrorClassPermanent {
+			t.Errorf("%s: class = %s, want permanent", name, got)
+		}
+		if !p.IsTokenInvalid(err) {
+			t.Errorf("%s: subscription not reported as invalid", name)
+		}
+	}
+
+	// Network errors stay transient.
+	if got := p.ClassifyError(errors.New("connection reset")); got != models.ErrorClassTransient {
+		t.Errorf("network error class = %s, want transient", got)
+	}
+}